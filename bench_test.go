@@ -0,0 +1,103 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// The responses of https://tools.ietf.org/html/rfc7541#appendix-C.5, encoded with a
+// dynamic table of 256 octets so entries are evicted. Encode uses Huffman coding, so
+// the blocks are the ones of appendix C.6.
+var benchmarkC5Headers = [][]Header{
+	{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	},
+}
+
+var benchmarkC5Blocks = []string{
+	"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+	"4883640effc1c0bf",
+	"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007",
+}
+
+func BenchmarkC5Encode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoder := NewEncoder(256)
+		for _, headers := range benchmarkC5Headers {
+			if _, err := encoder.Encode(headers); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkC5EncodeTo(b *testing.B) {
+	buf := make([]byte, 0, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoder := NewEncoder(256)
+		for _, headers := range benchmarkC5Headers {
+			var err error
+			if buf, err = encoder.EncodeTo(buf, headers); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkC5HuffmanEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, headers := range benchmarkC5Headers {
+			for _, header := range headers {
+				HuffmanEncode([]byte(header.Value))
+			}
+		}
+	}
+}
+
+func BenchmarkC5HuffmanEncodeAppend(b *testing.B) {
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, headers := range benchmarkC5Headers {
+			for _, header := range headers {
+				buf = HuffmanEncodeAppend(buf[:0], []byte(header.Value))
+			}
+		}
+	}
+}
+
+// The benchmarks must encode the same blocks as the RFC
+func TestBenchmarkC5Blocks(t *testing.T) {
+	encoder := NewEncoder(256)
+	decoder := NewDecoder(256)
+	for i, headers := range benchmarkC5Headers {
+		encoded, err := encoder.Encode(headers)
+		assert.Nil(t, err)
+		assert.Equal(t, benchmarkC5Blocks[i], hex.EncodeToString(encoded))
+
+		decoded, err := decoder.Decode(encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, headers, decoded)
+	}
+}
@@ -0,0 +1,28 @@
+package hpack
+
+// Creates the encoder and decoder for one HTTP/2 connection, both with a dynamic table
+// of maxTableSize octets, which is 4096 unless SETTINGS_HEADER_TABLE_SIZE was changed.
+//
+// HTTP/2 uses one compression context per direction of a connection: the encoder
+// compresses the header blocks sent to the peer and the decoder decompresses the header
+// blocks received from it. Both live as long as the connection and must not be shared
+// with other connections. Every header block received has to be decoded in the order it
+// arrives, even for streams that are discarded, and a decoding error is a connection
+// error of type COMPRESSION_ERROR, after which the decoder can't be used anymore.
+//
+// See https://tools.ietf.org/html/rfc7540#section-4.3
+func NewContext(maxTableSize int) (*Encoder, *Decoder) {
+	return NewEncoder(maxTableSize), NewDecoder(maxTableSize)
+}
+
+// Applies the SETTINGS_HEADER_TABLE_SIZE values of a connection to the pair returned by
+// NewContext: received is the value in the peer's SETTINGS frame and limits the encoder,
+// sent is the value in our SETTINGS frame and limits the dynamic table size updates the
+// decoder accepts. See Encoder.ApplySettings and Decoder.ApplySettings.
+func ApplyContextSettings(encoder *Encoder, decoder *Decoder, received int, sent int) error {
+	if err := encoder.ApplySettings(received); err != nil {
+		return err
+	}
+	decoder.ApplySettings(sent)
+	return nil
+}
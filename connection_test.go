@@ -0,0 +1,39 @@
+package hpack
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewContext(t *testing.T) {
+	encoder, decoder := NewContext(4096)
+
+	for i := 0; i < 10; i++ {
+		headers := []Header{
+			{Name: ":method", Value: "GET"},
+			{Name: ":path", Value: fmt.Sprintf("/item/%d", i%3)},
+			{Name: "custom-key", Value: "custom-value"},
+		}
+		encoded, err := encoder.Encode(headers)
+		assert.Nil(t, err)
+		decoded, err := decoder.Decode(encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, headers, decoded)
+		assert.Nil(t, AssertTablesMatch(encoder, decoder))
+	}
+
+	ApplyContextSettings(encoder, decoder, 64, 64)
+	headers := []Header{{Name: "custom-key", Value: "custom-value"}}
+	encoded, err := encoder.Encode(headers)
+	assert.Nil(t, err)
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+	assert.Equal(t, 64, decoder.dynamicTableSizeMax)
+
+	// the decoder rejects updates above the size it sent
+	_, err = decoder.Decode([]byte{0x3f, 0x22})
+	assert.NotNil(t, err)
+}
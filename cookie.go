@@ -0,0 +1,34 @@
+package hpack
+
+import "strings"
+
+// Splits a cookie header value into multiple cookie headers, one for each
+// cookie-pair. Each crumb can be indexed separately which gives better compression
+// when only some of the cookies change between requests.
+//
+// See https://tools.ietf.org/html/rfc7540#section-8.1.2.5
+func CrumbleCookie(value string) []Header {
+	crumbs := strings.Split(value, "; ")
+	headers := make([]Header, 0, len(crumbs))
+	for _, crumb := range crumbs {
+		if crumb == "" {
+			continue
+		}
+		headers = append(headers, Header{Name: "cookie", Value: crumb})
+	}
+	return headers
+}
+
+// Joins the values of all cookie headers into a single cookie header value,
+// in the order they appear in headers.
+//
+// See https://tools.ietf.org/html/rfc7540#section-8.1.2.5
+func JoinCookies(headers []Header) string {
+	crumbs := make([]string, 0)
+	for _, header := range headers {
+		if header.Name == "cookie" {
+			crumbs = append(crumbs, header.Value)
+		}
+	}
+	return strings.Join(crumbs, "; ")
+}
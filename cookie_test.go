@@ -0,0 +1,58 @@
+package hpack
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCrumbleCookie(t *testing.T) {
+	assert.Equal(t, []Header{
+		{"cookie", "a=b", false},
+		{"cookie", "c=d", false},
+		{"cookie", "e=f", false},
+	}, CrumbleCookie("a=b; c=d; e=f"))
+	assert.Equal(t, []Header{{"cookie", "a=b", false}}, CrumbleCookie("a=b"))
+	assert.Equal(t, []Header{}, CrumbleCookie(""))
+}
+
+func TestJoinCookies(t *testing.T) {
+	headers := []Header{
+		{":method", "GET", false},
+		{"cookie", "a=b", false},
+		{"accept", "*/*", false},
+		{"cookie", "c=d", false},
+	}
+	assert.Equal(t, "a=b; c=d", JoinCookies(headers))
+	assert.Equal(t, "", JoinCookies([]Header{{":method", "GET", false}}))
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	cookie := "session=8f2a; theme=dark; lang=en-US"
+
+	encoder := NewEncoder(256)
+	encoded, err := encoder.Encode(CrumbleCookie(cookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(headers))
+	assert.Equal(t, cookie, JoinCookies(headers))
+
+	// only the changed crumb needs a literal, the rest are indexed
+	encoded, err = encoder.Encode(CrumbleCookie("session=8f2a; theme=light; lang=en-US"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0xc0), encoded[0])
+	assert.Equal(t, byte(0xbf), encoded[len(encoded)-1])
+	headers, err = decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "session=8f2a; theme=light; lang=en-US", JoinCookies(headers))
+}
@@ -0,0 +1,99 @@
+//go:build go1.18
+
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Header blocks from RFC 7541 Appendix C
+var fuzzSeedBlocks = []string{
+	"400a637573746f6d2d6b65790d637573746f6d2d686561646572",
+	"040c2f73616d706c652f70617468",
+	"100870617373776f726406736563726574",
+	"82",
+	"828684410f7777772e6578616d706c652e636f6d",
+	"828684be58086e6f2d6361636865",
+	"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+	"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+	"828684be5886a8eb10649cbf",
+	"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+	"4803333037c1c0bf",
+	"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b2076657273696f6e3d31",
+	"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+	"4883640effc1c0bf",
+	"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007",
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range fuzzSeedBlocks {
+		block, err := hex.DecodeString(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(block)
+	}
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		// errors are expected for arbitrary input, panics are not
+		NewDecoder(4096).Decode(block)
+	})
+}
+
+// Parses the header blocks of a FuzzRoundTrip input: blocks are separated by an empty line
+// and each line is a "name: value" header, a name starting with '!' is a sensitive header.
+func fuzzHeaderBlocks(data string) [][]Header {
+	blocks := make([][]Header, 0)
+	for _, block := range strings.Split(data, "\n\n") {
+		headers := make([]Header, 0)
+		for _, line := range strings.Split(block, "\n") {
+			name, value, _ := strings.Cut(line, ": ")
+			sensitive := strings.HasPrefix(name, "!")
+			headers = append(headers, Header{Name: strings.TrimPrefix(name, "!"), Value: value, Sensitive: sensitive})
+		}
+		blocks = append(blocks, headers)
+	}
+	return blocks
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("custom-key: custom-value\n:method: GET\ncustom-key: custom-value\n\ncache-control: no-cache\ncustom-key: custom-value", true, uint16(256))
+	f.Add("!password: secret\npassword: secret\n\n!password: secret", true, uint16(0))
+	// RFC 7541 Appendix C.5, entries are evicted in the middle of the blocks
+	f.Add(":status: 302\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:21 GMT\nlocation: https://www.example.com\n\n"+
+		":status: 307\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:21 GMT\nlocation: https://www.example.com\n\n"+
+		":status: 200\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:22 GMT\nlocation: https://www.example.com\n"+
+		"content-encoding: gzip\nset-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1", false, uint16(256))
+	f.Add("a: 1\nb: 2\na: 1\nc: 3\nb: 2\n\nc: 3\na: 1", false, uint16(70))
+
+	f.Fuzz(func(t *testing.T, data string, huffman bool, tableSize uint16) {
+		encoder := NewEncoder(4096)
+		decoder := NewDecoder(4096)
+		encoder.SetDynamicTableMaxSize(int(tableSize) % 4097)
+
+		for _, headers := range fuzzHeaderBlocks(data) {
+			encoded, err := encoder.EncodeTrusted(headers, huffman)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decoder.Decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(headers) {
+				t.Fatalf("decoded %d headers, expected %d", len(decoded), len(headers))
+			}
+			for x := range headers {
+				if decoded[x] != headers[x] {
+					t.Fatalf("decoded %v, expected %v", decoded[x], headers[x])
+				}
+			}
+			if err := AssertTablesMatch(encoder, decoder); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
@@ -5,8 +5,12 @@
 package hpack
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 )
 
 type Header struct {
@@ -16,19 +20,135 @@ type Header struct {
 	Sensitive bool
 }
 
+// Returns the header formatted as "name: value", with a "(sensitive)"
+// suffix if the header is marked as Sensitive.
+func (header Header) String() string {
+	if header.Sensitive {
+		return header.Name + ": " + header.Value + " (sensitive)"
+	}
+	return header.Name + ": " + header.Value
+}
+
+// The representation of a header field in a header block.
+//
+// https://tools.ietf.org/html/rfc7541#section-6
+type Representation int
+
+// A decoded header along with the representation it was encoded with.
+//
+// This allows a header to be re-encoded with the same representation, for example
+// a proxy can keep a header that was sent as a literal without indexing out of its
+// own dynamic table.
+type HeaderField struct {
+	Header
+
+	Representation Representation
+
+	// The value as it was encoded in the header block and whether it was Huffman encoded.
+	// These are only set for literal representations when enabled with SetCaptureRawValues.
+	RawValue     []byte
+	ValueHuffman bool
+}
+
+const (
+	RepresentationIndexed Representation = iota
+	RepresentationLiteralIncrementalIndexing
+	RepresentationLiteralNotIndexed
+	RepresentationLiteralNeverIndexed
+	RepresentationDynamicTableSizeUpdate
+)
+
+func (representation Representation) String() string {
+	switch representation {
+	case RepresentationIndexed:
+		return "indexed"
+	case RepresentationLiteralIncrementalIndexing:
+		return "literal with incremental indexing"
+	case RepresentationLiteralNotIndexed:
+		return "literal without indexing"
+	case RepresentationLiteralNeverIndexed:
+		return "literal never indexed"
+	case RepresentationDynamicTableSizeUpdate:
+		return "dynamic table size update"
+	default:
+		return fmt.Sprintf("Representation(%d)", int(representation))
+	}
+}
+
 var ErrIntegerValueTooLarge = errors.New("integer value larger than max value")
 var ErrIntegerEncodedLengthTooLong = errors.New("integer encoded length is too long")
+var ErrIntegerNotMinimal = errors.New("integer is encoded with more octets than necessary")
 var ErrStringLiteralLengthTooLong = errors.New("string literal length is too long")
-
+var ErrIntegerTruncated = errors.New("ran out of data while reading HPACK integer")
+var ErrStringLiteralTruncated = errors.New("ran out of data while reading string literal")
+var ErrInvalidPrefixLength = errors.New("prefix length in bits must be >= 1 and <= 8")
+var ErrPrefixBitsOverlap = errors.New("prefix bits overlap the bits of the integer prefix")
+var ErrNegativeInteger = errors.New("integer is negative")
+var ErrInvalidHeaderName = errors.New("invalid header field name")
+var ErrInvalidHeaderValue = errors.New("invalid header field value")
+var ErrHuffmanNotAllowed = errors.New("huffman encoded string literals are not allowed")
+var ErrEmptyBlock = errors.New("header block is empty")
+var ErrDecodeStalled = errors.New("header field was parsed without consuming any data")
+var ErrPseudoHeaderAfterRegular = errors.New("pseudo-header field after a regular header field")
+var ErrUnknownPseudoHeader = errors.New("unknown pseudo-header field")
+var ErrEmptyHeaderName = errors.New("header field name is empty")
+var ErrIndexNotFound = errors.New("index not found")
+var ErrInvalidStatus = errors.New("status must be between 100 and 599")
+var ErrDynamicTableSizeTooLarge = errors.New("dynamic table size update is larger than the maximum size")
+var ErrDynamicTableSizeInconsistent = errors.New("dynamic table size doesn't match its entries")
+
+// The default largest integer value accepted by a decoder. This can be raised
+// with SetMaxIntegerValue up to the size of an int (2^63-1 on 64-bit platforms).
 var DefaultMaxIntegerValue = ((1 << 32) - 1)
+
+// The default largest number of octets accepted for a single integer, including the
+// prefix octet. This is a resource limit, not a limit of the encoding: 6 octets are enough
+// for any integer up to DefaultMaxIntegerValue, longer encodings can be accepted with
+// SetMaxIntegerEncodedLength.
 var DefaultMaxIntegerEncodedLength = 6
 var DefaultMaxStringLiteralLength = 1024 * 64
+var DefaultMaxDecodedStringLength = 1024 * 64
 
 type Encoder struct {
 	dynamicTable                  []Header
 	dynamicTableSizeMax           int
 	dynamicTableSizeCurrent       int
 	pendingDynamicTableSizeUpdate bool
+	pendingDynamicTableSizeMin    int
+
+	staticTable                   [][2]string
+	staticTableEncoding           map[string]int
+	staticTableEncodingWithValues map[string]int
+	useStaticValueMatch           bool
+
+	huffmanPolicy   func(header Header) bool
+	onEvict         func(evicted Header)
+	validateHeaders bool
+	normalizeNames  bool
+
+	neverIndexedNames  map[string]bool
+	sensitivePredicate func(name string) bool
+	evictionThreshold  int
+	entrySize          func(name string, value string) int
+
+	indexingPolicy func(header Header, seenNameBefore bool) bool
+	// the names of the headers encoded since the indexing policy was set
+	seenNames map[string]bool
+
+	stats             EncoderStats
+	lastEncodeEvicted int
+}
+
+// Statistics accumulated by an encoder across all encoded header fields.
+type EncoderStats struct {
+	// Total length of the names and values of all encoded headers
+	UncompressedBytes int
+	// Total length of the encoded output, including dynamic table size updates
+	EncodedBytes int
+	// Number of header fields encoded as indexed references
+	IndexedFields int
+	// Number of header fields encoded as literals
+	LiteralFields int
 }
 
 // A decoder is stateful and updates the internal compression context during processing
@@ -37,15 +157,112 @@ type Encoder struct {
 // If HTTP/2 is used, a single decoder instance must be used during the lifetime of a connection, see:
 // https://tools.ietf.org/html/rfc7540#section-4.3
 type Decoder struct {
+	staticTable                   [][2]string
+	staticTableEncoding           map[string]int
+	staticTableEncodingWithValues map[string]int
+
 	dynamicTable            []Header
 	dynamicTableSizeMax     int
 	dynamicTableSizeCurrent int
+	dynamicTableSizeLimit   int
 
 	integerValueMax         int
 	integerEncodedLengthMax int
 	stringLiteralLengthMax  int
+	decodedStringLengthMax  int
+	allowHuffman            bool
+	rejectEmptyBlock        bool
+	captureRawValues        bool
+
+	validatePseudoHeaderOrder bool
+	rejectUnknownPseudoHeader bool
+	rejectEmptyNames          bool
+	rejectNonMinimalIntegers  bool
+	oversizeStringPolicy      OversizeStringPolicy
+	lenientIndexErrors        bool
+
+	// the last string literal read, only tracked when captureRawValues is set
+	lastRawString     []byte
+	lastStringHuffman bool
+
+	onEvict   func(evicted Header)
+	onInsert  func(inserted Header)
+	tracer    func(event DecodeEvent)
+	interner  func(s string) string
+	entrySize func(name string, value string) int
+
+	// collects the changes to the dynamic table during DecodeWithInfo
+	info *DecodeInfo
+}
+
+// Describes how the dynamic table changed while a header block was decoded, see DecodeWithInfo.
+type DecodeInfo struct {
+	// The sizes of the dynamic table size updates in the block, in order
+	SizeUpdatesApplied []int
+	// The number of entries evicted from the dynamic table
+	Evictions int
 }
 
+// The kind of a DecodeEvent
+type DecodeEventType int
+
+const (
+	// An indexed header field was decoded
+	EventIndexedField DecodeEventType = iota
+	// A literal header field was decoded
+	EventLiteralField
+	// A dynamic table size update was decoded
+	EventSizeUpdate
+	// An entry was evicted from the dynamic table
+	EventEviction
+	// An indexed header field with an index that is out of range was skipped,
+	// see SetLenientIndexErrors
+	EventSkippedIndex
+)
+
+func (eventType DecodeEventType) String() string {
+	switch eventType {
+	case EventIndexedField:
+		return "indexed field"
+	case EventLiteralField:
+		return "literal field"
+	case EventSizeUpdate:
+		return "size update"
+	case EventEviction:
+		return "eviction"
+	case EventSkippedIndex:
+		return "skipped index"
+	default:
+		return fmt.Sprintf("DecodeEventType(%d)", int(eventType))
+	}
+}
+
+// An event reported to the tracer set with SetTracer.
+type DecodeEvent struct {
+	Type DecodeEventType
+
+	// The decoded header of a field, or the evicted entry
+	Header Header
+	// The representation of a field
+	Representation Representation
+	// The index of an indexed field or skipped index, or the index of the name of a literal field
+	// which is 0 if the name is a literal
+	Index int
+	// The new maximum size of the dynamic table for a size update
+	Size int
+}
+
+// Decides what a decoder does with a header field that has a string literal that is
+// longer than the limits set with SetMaxStringLiteralLength and SetMaxDecodedStringLength.
+type OversizeStringPolicy int
+
+const (
+	// Decoding the header block fails with ErrStringLiteralLengthTooLong
+	PolicyError OversizeStringPolicy = iota
+	// The header field is skipped and decoding continues with the next header field
+	PolicySkip
+)
+
 const (
 	headerFieldIndexed                 = 128
 	headerFieldLiteralIncrementalIndex = 64
@@ -58,293 +275,1557 @@ const (
 	huffmanEncoded = 1 << 7
 )
 
+// The length of a string literal is an integer with a 7 bit prefix, the high bit of the
+// first octet is the Huffman flag. Encoding and decoding must agree on this.
+//
+// https://tools.ietf.org/html/rfc7541#section-5.2
+const stringLengthPrefix = 7
+
+// The overhead in octets of an entry in the dynamic table, in addition to
+// the length of its name and value.
+//
+// https://tools.ietf.org/html/rfc7541#section-4.1
+const dynamicEntryOverhead = 32
+
+func dynamicEntrySize(name string, value string) int {
+	return dynamicEntryOverhead + len(name) + len(value)
+}
+
 func NewEncoder(dynamicTableSizeMax int) *Encoder {
 	return &Encoder{
+		staticTable:                   staticTable,
+		staticTableEncoding:           staticTableEncoding,
+		staticTableEncodingWithValues: staticTableEncodingWithValues,
 		dynamicTableSizeMax:           dynamicTableSizeMax,
 		dynamicTableSizeCurrent:       0,
 		pendingDynamicTableSizeUpdate: false,
+		useStaticValueMatch:           true,
+		evictionThreshold:             -1,
 	}
 }
 
+// Creates an encoder that uses entries as the static table instead of the
+// static table defined by HPACK. Indices of the dynamic table start after the
+// last entry of the custom static table.
+//
+// This is not interoperable with other HPACK implementations, the peer must
+// use a decoder with the same static table, see NewDecoderWithStaticTable.
+func NewEncoderWithStaticTable(entries [][2]string, dynamicTableSizeMax int) *Encoder {
+	encoder := NewEncoder(dynamicTableSizeMax)
+	encoder.staticTable = append([][2]string{}, entries...)
+	encoder.staticTableEncoding, encoder.staticTableEncodingWithValues = newStaticTableEncoding(entries)
+	return encoder
+}
+
 func NewDecoder(dynamicTableSizeMax int) *Decoder {
 	return &Decoder{
-		dynamicTableSizeMax:     dynamicTableSizeMax,
-		dynamicTableSizeCurrent: 0,
-		integerEncodedLengthMax: DefaultMaxIntegerEncodedLength,
-		integerValueMax:         DefaultMaxIntegerValue,
-		stringLiteralLengthMax:  DefaultMaxStringLiteralLength,
+		staticTable:                   staticTable,
+		staticTableEncoding:           staticTableEncoding,
+		staticTableEncodingWithValues: staticTableEncodingWithValues,
+		dynamicTableSizeMax:           dynamicTableSizeMax,
+		dynamicTableSizeCurrent:       0,
+		dynamicTableSizeLimit:         dynamicTableSizeMax,
+		integerEncodedLengthMax:       DefaultMaxIntegerEncodedLength,
+		integerValueMax:               DefaultMaxIntegerValue,
+		stringLiteralLengthMax:        DefaultMaxStringLiteralLength,
+		decodedStringLengthMax:        DefaultMaxDecodedStringLength,
+		allowHuffman:                  true,
 	}
 }
 
+// Creates a decoder that uses entries as the static table instead of the
+// static table defined by HPACK, see NewEncoderWithStaticTable.
+func NewDecoderWithStaticTable(entries [][2]string, dynamicTableSizeMax int) *Decoder {
+	decoder := NewDecoder(dynamicTableSizeMax)
+	decoder.staticTable = append([][2]string{}, entries...)
+	decoder.staticTableEncoding, decoder.staticTableEncodingWithValues = newStaticTableEncoding(entries)
+	return decoder
+}
+
 func (decoder *Decoder) readPrefixedLengthString(buf []byte, prefixLength int) (remainingBuf []byte, str string, err error) {
 	rest, huffman, length, err := decoder.DecodeInteger(buf, prefixLength)
 	if err != nil {
-		return buf, "", err
+		return nil, "", err
+	}
+
+	if length > decoder.stringLiteralLengthMax {
+		return nil, "", ErrStringLiteralLengthTooLong
+	}
+
+	if huffman&huffmanEncoded == huffmanEncoded {
+		if !decoder.allowHuffman {
+			return nil, "", ErrHuffmanNotAllowed
+		}
+		if len(rest) < length {
+			return nil, "", ErrStringLiteralTruncated
+		}
+		decoded, err := huffmanDecode(rest[:length], lookupTable, decoder.decodedStringLengthMax)
+		if err != nil {
+			return nil, "", err
+		}
+		if decoder.captureRawValues {
+			decoder.lastRawString, decoder.lastStringHuffman = rest[:length], true
+		}
+		return rest[length:], decoder.intern(string(decoded)), nil
+	} else {
+		if length > decoder.decodedStringLengthMax {
+			return nil, "", ErrStringLiteralLengthTooLong
+		}
+		if len(rest) < length {
+			return nil, "", ErrStringLiteralTruncated
+		}
+		str := decoder.intern(string(rest[:length]))
+		if decoder.captureRawValues {
+			decoder.lastRawString, decoder.lastStringHuffman = rest[:length], false
+		}
+		return rest[length:], str, nil
+	}
+}
+
+func (decoder *Decoder) getIndexedNameValue(index int) (string, string, error) {
+	// index 0 is not used and would be before the first entry of the static table
+	if index <= 0 {
+		return "", "", fmt.Errorf("%w: index %d is out of range of the static table (%d entries)", ErrIndexNotFound, index, len(decoder.staticTable))
+	}
+	if index > len(decoder.staticTable) {
+		dynamicIndex := index - len(decoder.staticTable)
+		if dynamicIndex > len(decoder.dynamicTable) {
+			return "", "", fmt.Errorf("%w: index %d is past the end of the dynamic table (dynamic index %d, %d entries)", ErrIndexNotFound, index, dynamicIndex, len(decoder.dynamicTable))
+		}
+		return decoder.dynamicTable[dynamicIndex-1].Name, decoder.dynamicTable[dynamicIndex-1].Value, nil
+	}
+	return decoder.staticTable[index-1][0], decoder.staticTable[index-1][1], nil
+}
+
+// Returns the index in the static or dynamic table that an encoder would use to represent
+// header, and whether the entry matches both the name and value or only the name. This
+// uses the same lookup as the encoder, so it can be used to check an encoder's choices.
+//
+// If no entry has the header's name, -1 is returned.
+func (decoder *Decoder) IndexOf(header Header) (index int, exact bool) {
+	if header.Value != "" {
+		if entry, ok := decoder.staticTableEncodingWithValues[header.Name+":"+header.Value]; ok {
+			return entry, true
+		}
+	}
+	for x, entry := range decoder.dynamicTable {
+		if entry.Name == header.Name && entry.Value == header.Value {
+			return len(decoder.staticTable) + x + 1, true
+		}
+	}
+	if entry, ok := decoder.staticTableEncoding[header.Name]; ok {
+		return entry, false
+	}
+	return -1, false
+}
+
+// Updates the decoder's dynamic table maximum size and evicts any
+// headers if more space is needed to resize to newMaxSize.
+//
+// The limit for dynamic table size updates received from the encoder is not changed,
+// it is set with ApplySettings.
+//
+// ErrDynamicTableSizeInconsistent is returned, without resizing, if the size of the
+// dynamic table doesn't match its entries.
+func (decoder *Decoder) SetDynamicTableMaxSize(newMaxSize int) error {
+	return decoder.resizeDynamicTable(newMaxSize)
+}
+
+// Applies a SETTINGS_HEADER_TABLE_SIZE value sent to the peer. This only sets the limit for
+// dynamic table size updates received from the encoder, the dynamic table keeps its current
+// maximum size until the encoder sends a dynamic table size update.
+//
+// See https://tools.ietf.org/html/rfc7541#section-4.2
+func (decoder *Decoder) ApplySettings(headerTableSize int) {
+	decoder.dynamicTableSizeLimit = headerTableSize
+}
+
+func (decoder *Decoder) resizeDynamicTable(newMaxSize int) error {
+	if err := decoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	decoder.dynamicTableSizeMax = newMaxSize
+	_, err := decoder.evictEntries(0, newMaxSize)
+	return err
+}
+
+// Sets the largest integer that is allowed, anything > value will result in an error
+//
+// The value can be raised up to the size of an int (2^63-1 on 64-bit platforms).
+// Integers that would overflow an int are always rejected. Note that large
+// integers also need more octets, see SetMaxIntegerEncodedLength.
+func (decoder *Decoder) SetMaxIntegerValue(value int) {
+	decoder.integerValueMax = value
+}
+
+// Sets whether integers encoded with more octets than necessary, i.e. ending with a redundant
+// zero continuation octet, result in ErrIntegerNotMinimal, the default is false.
+//
+// HPACK allows these encodings, but they aren't produced by a conforming encoder and
+// can be used to evade inspection that compares encoded header blocks.
+func (decoder *Decoder) SetRejectNonMinimalIntegers(reject bool) {
+	decoder.rejectNonMinimalIntegers = reject
+}
+
+// Sets the maximum bytes allowed for encoding a single integer, including the prefix octet.
+//
+// Some peers send integers with more octets than necessary, or integers above
+// DefaultMaxIntegerValue, the limit can be raised to accept them. With a 10 octet limit
+// any integer that fits in an int on 64-bit platforms is accepted, integers that would
+// overflow an int are still rejected with ErrIntegerValueTooLarge.
+func (decoder *Decoder) SetMaxIntegerEncodedLength(length int) {
+	decoder.integerEncodedLengthMax = length
+}
+
+// Sets the maximum length of a string literal
+// For compressed string literals the length check will be against the
+// compressed length, not the uncompressed length, see SetMaxDecodedStringLength
+func (decoder *Decoder) SetMaxStringLiteralLength(length int) {
+	decoder.stringLiteralLengthMax = length
+}
+
+// Sets the maximum length of a string literal after it has been decoded.
+// Huffman encoded strings can expand when decoded, decoding is aborted with
+// ErrStringLiteralLengthTooLong as soon as the decoded length exceeds the maximum.
+func (decoder *Decoder) SetMaxDecodedStringLength(length int) {
+	decoder.decodedStringLengthMax = length
+}
+
+// Returns a copy of the entries in the decoder's dynamic table, the most recently
+// inserted entry first. The first entry has index 62 when the HPACK static table is used.
+func (decoder *Decoder) DynamicTableEntries() []Header {
+	return append([]Header{}, decoder.dynamicTable...)
+}
+
+// Compares the dynamic tables of an encoder and the decoder of its peer entry by entry,
+// returning an error describing every difference or nil if the tables match. This is
+// meant for tests, the tables match after each header block is encoded and decoded.
+func AssertTablesMatch(enc *Encoder, dec *Decoder) error {
+	diffs := make([]string, 0)
+	if len(enc.dynamicTable) != len(dec.dynamicTable) {
+		diffs = append(diffs, fmt.Sprintf("encoder has %d entries, decoder has %d entries", len(enc.dynamicTable), len(dec.dynamicTable)))
+	}
+	if enc.dynamicTableSizeMax != dec.dynamicTableSizeMax {
+		diffs = append(diffs, fmt.Sprintf("encoder max size is %d, decoder max size is %d", enc.dynamicTableSizeMax, dec.dynamicTableSizeMax))
+	}
+	for x := 0; x < len(enc.dynamicTable) || x < len(dec.dynamicTable); x++ {
+		encEntry, decEntry := "<none>", "<none>"
+		if x < len(enc.dynamicTable) {
+			encEntry = strconv.Quote(enc.dynamicTable[x].String())
+		}
+		if x < len(dec.dynamicTable) {
+			decEntry = strconv.Quote(dec.dynamicTable[x].String())
+		}
+		if encEntry != decEntry {
+			diffs = append(diffs, fmt.Sprintf("index %d: encoder has %s, decoder has %s", len(enc.staticTable)+x+1, encEntry, decEntry))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("dynamic tables differ: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// Sets the function that computes the size of a dynamic table entry, which decides when
+// entries are evicted. The default is the size defined by HPACK, 32 plus the lengths of
+// the name and value, see https://tools.ietf.org/html/rfc7541#section-4.1. A function that
+// adds Go's per string overhead bounds the memory the table actually uses.
+//
+// Any other function diverges from the table size semantics of the wire protocol: the peer's
+// encoder must use the same function, see Encoder.SetEntrySizeFunc, or the dynamic tables
+// get out of sync. A nil function restores the default.
+//
+// ErrDynamicTableSizeInconsistent is returned, without changing the function, if the size
+// of the dynamic table doesn't match its entries.
+func (decoder *Decoder) SetEntrySizeFunc(entrySize func(name string, value string) int) error {
+	if err := decoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	decoder.entrySize = entrySize
+	decoder.dynamicTableSizeCurrent = decoder.dynamicTableEntriesSize()
+	return decoder.resizeDynamicTable(decoder.dynamicTableSizeMax)
+}
+
+func (decoder *Decoder) entrySizeOf(name string, value string) int {
+	if decoder.entrySize == nil {
+		return dynamicEntrySize(name, value)
+	}
+	return decoder.entrySize(name, value)
+}
+
+// Sets a function that is called for each entry evicted from the decoder's dynamic table,
+// oldest entry first.
+func (decoder *Decoder) SetOnEvict(onEvict func(evicted Header)) {
+	decoder.onEvict = onEvict
+}
+
+// Sets a function that is called with an event for each header field, dynamic table size
+// update and eviction while decoding. The event for a literal with incremental indexing is
+// reported before the evictions needed to insert it.
+//
+// Passing nil disables tracing, which is the default.
+func (decoder *Decoder) SetTracer(tracer func(event DecodeEvent)) {
+	decoder.tracer = tracer
+}
+
+// Sets whether an indexed header field with an index that is out of range is skipped
+// instead of failing the header block. A skipped field is reported to the tracer as an
+// EventSkippedIndex and decoding continues with the next header field.
+//
+// This violates the HPACK specification, which requires such a block to be treated as a
+// decoding error, and is meant for diagnosing broken encoders only. The decoder's dynamic
+// table is likely out of sync with the encoder after a field was skipped.
+func (decoder *Decoder) SetLenientIndexErrors(lenient bool) {
+	decoder.lenientIndexErrors = lenient
+}
+
+// Sets a function that every decoded string literal, both names and values, is passed
+// through, e.g. to return a shared copy of common values like user-agent strings instead
+// of keeping a new string for every header. The interner must return a string equal to
+// its argument. A nil interner removes it.
+//
+// Names and values of indexed fields come from the static and dynamic tables and are
+// already shared, so they aren't passed to the interner.
+func (decoder *Decoder) SetStringInterner(interner func(s string) string) {
+	decoder.interner = interner
+}
+
+func (decoder *Decoder) intern(s string) string {
+	if decoder.interner == nil {
+		return s
+	}
+	return decoder.interner(s)
+}
+
+// Sets a function that is called for each entry inserted into the decoder's dynamic table,
+// after any entries were evicted to make room for it. A header that is larger than the
+// dynamic table empties the table but isn't inserted, so the function isn't called.
+func (decoder *Decoder) SetOnInsert(onInsert func(inserted Header)) {
+	decoder.onInsert = onInsert
+}
+
+// Sets whether Huffman encoded string literals are allowed, the default is true.
+// When false, decoding a string literal with the Huffman bit set results in an error.
+func (decoder *Decoder) SetAllowHuffman(allow bool) {
+	decoder.allowHuffman = allow
+}
+
+// Sets whether decoding an empty header block results in ErrEmptyBlock, the default is false.
+// This is useful when the caller expects at least one header field, as an empty block
+// could be the result of a truncated frame.
+func (decoder *Decoder) SetRejectEmptyBlock(reject bool) {
+	decoder.rejectEmptyBlock = reject
+}
+
+// Sets what happens when a string literal is longer than the limits, the default is PolicyError.
+//
+// With PolicySkip literal header fields without indexing or never indexed are dropped from the
+// decoded headers, without decoding the string. A literal header field with incremental indexing
+// still results in ErrStringLiteralLengthTooLong, as skipping it would leave the dynamic table out
+// of sync with the encoder.
+//
+// Skipping means headers can silently disappear, which can change how a request is handled, e.g.
+// a dropped authorization or content-length header. Only skip when that is acceptable.
+func (decoder *Decoder) SetOversizeStringPolicy(policy OversizeStringPolicy) {
+	decoder.oversizeStringPolicy = policy
+}
+
+// Sets whether a literal header field with incremental indexing that has an empty name
+// results in ErrEmptyHeaderName, the default is false. The field is rejected before it
+// is inserted, so nameless entries never end up in the dynamic table.
+func (decoder *Decoder) SetRejectEmptyNames(reject bool) {
+	decoder.rejectEmptyNames = reject
+}
+
+// Sets whether a pseudo-header field (a name starting with ':') that follows a regular
+// header field in the same header block results in ErrPseudoHeaderAfterRegular, the default is false.
+//
+// See https://tools.ietf.org/html/rfc7540#section-8.1.2.1
+func (decoder *Decoder) SetValidatePseudoHeaderOrder(validate bool) {
+	decoder.validatePseudoHeaderOrder = validate
+}
+
+// Sets whether a pseudo-header field other than those defined for HTTP/2 requests and
+// responses (:method, :scheme, :authority, :path, :protocol and :status) results in
+// ErrUnknownPseudoHeader, the default is false.
+func (decoder *Decoder) SetRejectUnknownPseudoHeaders(reject bool) {
+	decoder.rejectUnknownPseudoHeader = reject
+}
+
+// Checks a decoded header against the pseudo-header options, regularSeen tracks whether a
+// regular header field was already decoded in the block.
+func (decoder *Decoder) checkPseudoHeader(header *Header, regularSeen *bool) error {
+	if !strings.HasPrefix(header.Name, ":") {
+		*regularSeen = true
+		return nil
+	}
+	if decoder.validatePseudoHeaderOrder && *regularSeen {
+		return ErrPseudoHeaderAfterRegular
+	}
+	if decoder.rejectUnknownPseudoHeader {
+		switch header.Name {
+		case ":method", ":scheme", ":authority", ":path", ":protocol", ":status":
+		default:
+			return ErrUnknownPseudoHeader
+		}
+	}
+	return nil
+}
+
+// Sets whether DecodeFields captures the encoded bytes of each literal value along with
+// whether it was Huffman encoded, so the value can be re-emitted exactly as it was received.
+//
+// The captured RawValue slices refer to the block passed to DecodeFields, they are not copied.
+func (decoder *Decoder) SetCaptureRawValues(capture bool) {
+	decoder.captureRawValues = capture
+	decoder.lastRawString = nil
+}
+
+// Finds the header in the table.
+// Returns the index and a bool indicating if the entry includes the value also.
+// If the entry wasn't found the index returned is -1
+func (encoder *Encoder) findHeaderInTable(name string, value string) (int, bool) {
+	var entry int
+	var ok bool
+
+	if value != "" && encoder.useStaticValueMatch {
+		entry, ok = encoder.staticTableEncodingWithValues[name+":"+value]
+		if ok {
+			return entry, true
+		}
+	}
+
+	for x, header := range encoder.dynamicTable {
+		if header.Name == name && header.Value == value {
+			return len(encoder.staticTable) + x + 1, true
+		}
+	}
+
+	entry, ok = encoder.staticTableEncoding[name]
+	if ok {
+		return entry, false
+	}
+	return -1, false
+}
+
+// Updates the encoder's dynamic table maximum size and evicts any
+// headers if more space is needed to resize to newMaxSize.
+//
+// After this call the next header field that is encoded will include
+// a dynamic table size update. If the size was changed more than once since
+// the last update was sent and an intermediate size was smaller than the final
+// size, the smallest size is sent first, followed by the final size.
+//
+// ErrDynamicTableSizeInconsistent is returned, without resizing, if the size of the
+// dynamic table doesn't match its entries.
+//
+// https://tools.ietf.org/html/rfc7541#section-4.2
+func (encoder *Encoder) SetDynamicTableMaxSize(newMaxSize int) error {
+	if err := encoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	if !encoder.pendingDynamicTableSizeUpdate || newMaxSize < encoder.pendingDynamicTableSizeMin {
+		encoder.pendingDynamicTableSizeMin = newMaxSize
+	}
+	encoder.dynamicTableSizeMax = newMaxSize
+	encoder.evictEntries(0, newMaxSize)
+	encoder.pendingDynamicTableSizeUpdate = true
+	return nil
+}
+
+// Sets whether headers that match a static table entry's name and value are encoded as
+// an indexed reference to the entry, the default is true. When false only the name of a
+// static table entry is referenced and the value is always sent as a literal, entries in
+// the dynamic table are still matched by name and value.
+func (encoder *Encoder) SetUseStaticValueMatch(use bool) {
+	encoder.useStaticValueMatch = use
+}
+
+// Applies a SETTINGS_HEADER_TABLE_SIZE value received from the peer: the dynamic table's
+// maximum size is set to headerTableSize, entries are evicted if needed and the dynamic
+// table size update(s) the peer must receive are sent at the start of the next header block.
+//
+// See https://tools.ietf.org/html/rfc7540#section-6.5.2
+func (encoder *Encoder) ApplySettings(headerTableSize int) error {
+	return encoder.SetDynamicTableMaxSize(headerTableSize)
+}
+
+// Sets a policy that decides for each header whether its strings are Huffman encoded,
+// overriding the huffman argument passed to the encode functions. This is useful for values
+// that don't compress well, like set-cookie values or base64 tokens.
+//
+// Passing nil restores the default behavior of using the huffman argument.
+func (encoder *Encoder) SetHuffmanPolicy(policy func(header Header) bool) {
+	encoder.huffmanPolicy = policy
+}
+
+// Returns the statistics accumulated since the encoder was created or ResetStats was called.
+func (encoder *Encoder) Stats() EncoderStats {
+	return encoder.stats
+}
+
+// Resets the encoder's statistics to zero.
+func (encoder *Encoder) ResetStats() {
+	encoder.stats = EncoderStats{}
+}
+
+// Sets the largest number of entries that may be evicted from the dynamic table to add
+// a header. A header that would evict more entries is encoded as a literal without
+// indexing instead, keeping the entries that are likely to be referenced again. This
+// avoids a single large header flushing the table.
+//
+// A negative k disables the threshold, which is the default.
+func (encoder *Encoder) SetEvictionThreshold(k int) {
+	encoder.evictionThreshold = k
+}
+
+// Sets a policy that decides whether a header that would be added to the dynamic table is
+// added, or encoded as a literal without indexing when it returns false. seenNameBefore tells
+// whether a header with the same name was encoded before, so e.g. a header can be indexed
+// only once its name repeats, keeping one-off headers from evicting entries that are reused.
+//
+// The names are tracked from when the policy is set, setting it again forgets them. The
+// encoder keeps every distinct name it encodes while a policy is set. A nil policy removes it.
+func (encoder *Encoder) SetIndexingPolicy(policy func(header Header, seenNameBefore bool) bool) {
+	encoder.indexingPolicy = policy
+	encoder.seenNames = nil
+	if policy != nil {
+		encoder.seenNames = make(map[string]bool)
+	}
+}
+
+// Adds a header name that is always encoded as a literal never indexed header field,
+// as if every header with that name was marked as Sensitive. This is useful for names
+// like authorization or cookie that carry secrets.
+//
+// The name is also added in lowercase, so it still matches the names lowercased by
+// SetNormalizeNames, e.g. "Authorization" applies to headers named "authorization".
+func (encoder *Encoder) AddNeverIndexedName(name string) {
+	if encoder.neverIndexedNames == nil {
+		encoder.neverIndexedNames = make(map[string]bool)
+	}
+	encoder.neverIndexedNames[name] = true
+	encoder.neverIndexedNames[strings.ToLower(name)] = true
+}
+
+// Sets a function that decides whether headers with a name are always encoded as a literal
+// never indexed header field, e.g. every name starting with x-secret-. It complements
+// Header.Sensitive and AddNeverIndexedName. A nil predicate removes it.
+func (encoder *Encoder) SetSensitivePredicate(predicate func(name string) bool) {
+	encoder.sensitivePredicate = predicate
+}
+
+// Returns a copy of the entries in the encoder's dynamic table, the most recently
+// inserted entry first. The first entry has index 62 when the HPACK static table is used.
+func (encoder *Encoder) DynamicTableEntries() []Header {
+	return append([]Header{}, encoder.dynamicTable...)
+}
+
+// Returns the number of entries that were evicted from the dynamic table to make room for
+// new entries during the most recent call to Encode, EncodeTrusted, EncodeIndexed or
+// EncodeNoDynamicIndexing. A header that frequently causes evictions can thrash the table.
+func (encoder *Encoder) LastEncodeEvicted() int {
+	return encoder.lastEncodeEvicted
+}
+
+// Sets the function that computes the size of a dynamic table entry, see
+// Decoder.SetEntrySizeFunc. The peer's decoder must use the same function.
+func (encoder *Encoder) SetEntrySizeFunc(entrySize func(name string, value string) int) error {
+	if err := encoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	encoder.entrySize = entrySize
+	encoder.dynamicTableSizeCurrent = encoder.dynamicTableEntriesSize()
+	encoder.evictEntries(0, encoder.dynamicTableSizeMax)
+	return nil
+}
+
+func (encoder *Encoder) entrySizeOf(name string, value string) int {
+	if encoder.entrySize == nil {
+		return dynamicEntrySize(name, value)
+	}
+	return encoder.entrySize(name, value)
+}
+
+// Sets a function that is called for each entry evicted from the encoder's dynamic table,
+// oldest entry first.
+func (encoder *Encoder) SetOnEvict(onEvict func(evicted Header)) {
+	encoder.onEvict = onEvict
+}
+
+// Enables validation of headers before they are encoded. Header names must be lowercase
+// HTTP tokens, optionally prefixed with ':' for pseudo-headers, and values must not contain
+// NUL, CR or LF.
+//
+// See https://tools.ietf.org/html/rfc7540#section-8.1.2
+func (encoder *Encoder) SetValidateHeaders(validate bool) {
+	encoder.validateHeaders = validate
+}
+
+// Enables lowercasing header names before they are looked up in the tables and encoded.
+// HTTP/2 requires lowercase header names, so this allows callers to pass names like
+// "Content-Type" and get the same output as "content-type". Values are never modified.
+func (encoder *Encoder) SetNormalizeNames(normalize bool) {
+	encoder.normalizeNames = normalize
+}
+
+// Applies name normalization and validation, if enabled, to a header before it is encoded.
+func (encoder *Encoder) prepareHeader(header Header, validate bool) (Header, error) {
+	if encoder.normalizeNames {
+		header.Name = strings.ToLower(header.Name)
+	}
+	if validate {
+		if err := validateHeader(header); err != nil {
+			return header, err
+		}
+	}
+	return header, nil
+}
+
+// Prepares every header with prepareHeader without encoding it, so an invalid header
+// is reported before any header of the list has modified the encoder's state. The same
+// goes for a dynamic table whose size doesn't match its entries.
+func (encoder *Encoder) checkHeaders(headers []Header, validate bool) error {
+	if err := encoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	if !validate {
+		return nil
+	}
+	for _, header := range headers {
+		if _, err := encoder.prepareHeader(header, validate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHeader(header Header) error {
+	name := header.Name
+	if len(name) > 0 && name[0] == ':' {
+		name = name[1:]
+	}
+	if len(name) == 0 {
+		return ErrInvalidHeaderName
+	}
+	for x := 0; x < len(name); x++ {
+		if !isLowercaseTokenChar(name[x]) {
+			return ErrInvalidHeaderName
+		}
+	}
+	for x := 0; x < len(header.Value); x++ {
+		switch header.Value[x] {
+		case 0, '\r', '\n':
+			return ErrInvalidHeaderValue
+		}
+	}
+	return nil
+}
+
+// https://tools.ietf.org/html/rfc7230#section-3.2.6
+func isLowercaseTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// Inserts entries into the encoder's dynamic table in order, as if each had been encoded
+// with incremental indexing, so the last entry becomes the most recent one. Entries are
+// evicted as needed to stay within the dynamic table's maximum size.
+//
+// This allows an encoder to start in a known state that matches a peer's decoder.
+// ErrDynamicTableSizeInconsistent is returned, without inserting any entry, if the size
+// of the dynamic table doesn't match its entries.
+func (encoder *Encoder) SeedDynamicTable(entries []Header) error {
+	if err := encoder.CheckDynamicTableSize(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// the table is consistent, so inserting can't fail
+		encoder.addNewDynamicEntry(entry.Name, entry.Value)
+	}
+	return nil
+}
+
+// Returns the index of an entry with name in the static table, or the dynamic table if the
+// static table has no such entry, -1 if neither has one.
+func (encoder *Encoder) findNameInTable(name string) int {
+	entry, ok := encoder.staticTableEncoding[name]
+	if ok {
+		return entry
+	}
+	for x, header := range encoder.dynamicTable {
+		if header.Name == name {
+			return len(encoder.staticTable) + x + 1
+		}
+	}
+	return -1
+}
+
+// This is a convenience function that encodes a list of headers
+// into a header block using Huffman compression and with incremental
+// indexing enabled.
+//
+// If a header is marked as Sensitive it will be encoded as a
+// never indexed header field
+func (encoder *Encoder) Encode(headers []Header) ([]byte, error) {
+	return encoder.encode(headers, true, encoder.validateHeaders)
+}
+
+func encodeLiteralString(str string, prefixLength int, huffman bool) []byte {
+	return appendLiteralString(make([]byte, 0), str, prefixLength, huffman)
+}
+
+// Appends str encoded as a string literal to dst, the length is computed before encoding
+// so the Huffman encoded data can be appended directly after it.
+func appendLiteralString(dst []byte, str string, prefixLength int, huffman bool) []byte {
+	if !huffman {
+		dst = appendInteger(dst, len(str), prefixLength, 0)
+		return append(dst, str...)
+	}
+	dst = appendInteger(dst, huffmanEncodedLen(str), prefixLength, huffmanEncoded)
+	return HuffmanEncodeAppend(dst, []byte(str))
+}
+
+// Encodes a string literal with a 7 bit length prefix, optionally with Huffman
+// compression, and writes it to w.
+//
+// See https://tools.ietf.org/html/rfc7541#section-5.2
+func WriteLiteralString(w io.Writer, s string, huffman bool) error {
+	_, err := w.Write(encodeLiteralString(s, stringLengthPrefix, huffman))
+	return err
+}
+
+// Encodes a header without Indexing and returns the encoded header field
+//
+// https://tools.ietf.org/html/rfc7541#appendix-C.2.2
+func (encoder *Encoder) EncodeNoDynamicIndexing(header Header, huffman bool) ([]byte, error) {
+	encoder.lastEncodeEvicted = 0
+	header, err := encoder.prepareHeader(header, encoder.validateHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.encodeHeaderField(make([]byte, 0), header, huffman, false)
+}
+
+// Encodes a header with Indexing and returns the encoded header field
+//
+// https://tools.ietf.org/html/rfc7541#appendix-C.2.1
+func (encoder *Encoder) EncodeIndexed(header Header, huffman bool) ([]byte, error) {
+	encoder.lastEncodeEvicted = 0
+	header, err := encoder.prepareHeader(header, encoder.validateHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.encodeHeaderField(make([]byte, 0), header, huffman, true)
+}
+
+// Encodes a header field decoded with DecodeFields using the same class of representation
+// against the encoder's own tables, e.g. in a proxy:
+//
+//   - an indexed field or literal with incremental indexing is encoded like EncodeIndexed
+//   - a literal without indexing is encoded like EncodeNoDynamicIndexing, so it's never
+//     added to the dynamic table
+//   - a literal never indexed is encoded as a literal never indexed
+//
+// A dynamic table size update can't be re-encoded and results in an error.
+func (encoder *Encoder) ReEncode(field HeaderField, huffman bool) ([]byte, error) {
+	encoder.lastEncodeEvicted = 0
+	header, err := encoder.prepareHeader(field.Header, encoder.validateHeaders)
+	if err != nil {
+		return nil, err
+	}
+	switch field.Representation {
+	case RepresentationIndexed, RepresentationLiteralIncrementalIndexing:
+		return encoder.encodeHeaderField(make([]byte, 0), header, huffman, true)
+	case RepresentationLiteralNotIndexed:
+		return encoder.encodeHeaderField(make([]byte, 0), header, huffman, false)
+	case RepresentationLiteralNeverIndexed:
+		header.Sensitive = true
+		return encoder.encodeHeaderField(make([]byte, 0), header, huffman, false)
+	default:
+		return nil, fmt.Errorf("can't re-encode a header field decoded as %s", field.Representation)
+	}
+}
+
+// Encodes the header block of an HTTP/2 response: the :status pseudo-header followed by
+// headers, with incremental indexing like EncodeTrusted. Common statuses like 200 or 404
+// are in the static table and are encoded as a single octet.
+//
+// ErrInvalidStatus is returned if status is not between 100 and 599. Headers are validated
+// if SetValidateHeaders is enabled.
+func (encoder *Encoder) EncodeResponse(status int, headers []Header, huffman bool) ([]byte, error) {
+	if status < 100 || status > 599 {
+		return nil, ErrInvalidStatus
+	}
+	response := make([]Header, 0, len(headers)+1)
+	response = append(response, Header{Name: ":status", Value: strconv.Itoa(status)})
+	response = append(response, headers...)
+	return encoder.encode(response, huffman, encoder.validateHeaders)
+}
+
+// Encodes the headers like Encode, but appends the header block to dst after truncating
+// it to zero length. The returned slice should be used in place of dst.
+//
+// This allows the caller to reuse the same buffer across header blocks to avoid
+// allocating a new one for each block, see DecodeReuse for the decoding side.
+func (encoder *Encoder) EncodeTo(dst []byte, headers []Header) ([]byte, error) {
+	return encoder.encodeTo(dst[:0], headers, true, encoder.validateHeaders)
+}
+
+// Encodes a list of headers into a header block with incremental indexing enabled,
+// skipping header validation even if it is enabled with SetValidateHeaders.
+//
+// The caller is responsible for making sure that every header name is a lowercase
+// HTTP token (optionally prefixed with ':' for pseudo-headers) and that no value
+// contains NUL, CR or LF. Invalid headers are encoded as is.
+func (encoder *Encoder) EncodeTrusted(headers []Header, huffman bool) ([]byte, error) {
+	return encoder.encode(headers, huffman, false)
+}
+
+// Returns how a header would be represented if it was encoded now with EncodeIndexed:
+// as an indexed reference, a literal added to the dynamic table, or a literal that
+// isn't added to the dynamic table. The encoder's state is not modified.
+func (encoder *Encoder) WouldIndex(header Header) Representation {
+	if encoder.normalizeNames {
+		header.Name = strings.ToLower(header.Name)
+	}
+	representation, _ := encoder.representationFor(header, true)
+	return representation
+}
+
+// Reports whether a header must be encoded as a literal never indexed header field.
+func (encoder *Encoder) isSensitive(header Header) bool {
+	if header.Sensitive || encoder.neverIndexedNames[header.Name] {
+		return true
+	}
+	return encoder.sensitivePredicate != nil && encoder.sensitivePredicate(header.Name)
+}
+
+// Decides how a header field is represented and the index it references, the index
+// is 0 if the name has to be sent as a literal. The encoder's state is not modified.
+func (encoder *Encoder) representationFor(header Header, addDynamicIndex bool) (Representation, int) {
+	if encoder.isSensitive(header) {
+		index := encoder.findNameInTable(header.Name)
+		if index == -1 {
+			index = 0
+		}
+		return RepresentationLiteralNeverIndexed, index
+	}
+
+	index, valueIndexed := encoder.findHeaderInTable(header.Name, header.Value)
+	if index != -1 && valueIndexed {
+		return RepresentationIndexed, index
+	}
+	if index == -1 {
+		index = 0
+	}
+	// an entry larger than the table can't be stored and adding it would only empty the table
+	entrySize := encoder.entrySizeOf(header.Name, header.Value)
+	if addDynamicIndex && entrySize <= encoder.dynamicTableSizeMax &&
+		(encoder.evictionThreshold < 0 || encoder.evictionsFor(entrySize) <= encoder.evictionThreshold) &&
+		(encoder.indexingPolicy == nil || encoder.indexingPolicy(header, encoder.seenNames[header.Name])) {
+		return RepresentationLiteralIncrementalIndexing, index
+	}
+	return RepresentationLiteralNotIndexed, index
+}
+
+// Returns the number of entries that would be evicted to add an entry of entrySize.
+func (encoder *Encoder) evictionsFor(entrySize int) int {
+	size := encoder.dynamicTableSizeCurrent + entrySize
+	evictions := 0
+	for x := len(encoder.dynamicTable) - 1; x >= 0 && size > encoder.dynamicTableSizeMax; x-- {
+		size -= encoder.entrySizeOf(encoder.dynamicTable[x].Name, encoder.dynamicTable[x].Value)
+		evictions += 1
+	}
+	return evictions
+}
+
+func encodeDynamicTableSizeUpdate(size int) []byte {
+	encoded := encodeInteger(size, 5)
+	encoded[0] |= headerFieldDynamicSizeUpdate
+	return encoded
+}
+
+// Appends the pending dynamic table size update(s) to encoded, if any. The smallest size
+// the table had since the last update is sent first if it's below the current size.
+func (encoder *Encoder) appendPendingSizeUpdate(encoded []byte) []byte {
+	if !encoder.pendingDynamicTableSizeUpdate {
+		return encoded
+	}
+	if encoder.pendingDynamicTableSizeMin < encoder.dynamicTableSizeMax {
+		encoded = append(encoded, encodeDynamicTableSizeUpdate(encoder.pendingDynamicTableSizeMin)...)
+	}
+	return append(encoded, encodeDynamicTableSizeUpdate(encoder.dynamicTableSizeMax)...)
+}
+
+// Returns the pending dynamic table size update(s) on their own, so they can be sent
+// separately from the next header field, e.g. at a precise position in a frame. The
+// update is no longer pending afterwards, so the next header block doesn't start with it.
+//
+// An empty slice is returned if no update is pending.
+func (encoder *Encoder) FlushPendingSizeUpdate() []byte {
+	encoded := encoder.appendPendingSizeUpdate(make([]byte, 0))
+	encoder.stats.EncodedBytes += len(encoded)
+	encoder.pendingDynamicTableSizeUpdate = false
+	return encoded
+}
+
+// Encodes a header field like renderHeaderField and updates the encoder's state.
+func (encoder *Encoder) encodeHeaderField(dst []byte, header Header, huffman bool, addDynamicIndex bool) ([]byte, error) {
+	encoded, representation := encoder.renderHeaderField(dst, header, huffman, addDynamicIndex)
+	if err := encoder.commitHeaderField(header, representation, len(encoded)-len(dst)); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// Encodes a header field, preceded by any pending dynamic table size update, and appends
+// it to dst without modifying the encoder's state. The state is updated with commitHeaderField once the
+// encoded header field is used.
+func (encoder *Encoder) renderHeaderField(dst []byte, header Header, huffman bool, addDynamicIndex bool) ([]byte, Representation) {
+	encoded := dst
+
+	if encoder.huffmanPolicy != nil {
+		huffman = encoder.huffmanPolicy(header)
+	}
+
+	encoded = encoder.appendPendingSizeUpdate(encoded)
+
+	representation, index := encoder.representationFor(header, addDynamicIndex)
+	switch representation {
+	case RepresentationIndexed:
+		return appendInteger(encoded, index, 7, headerFieldIndexed), representation
+	case RepresentationLiteralIncrementalIndexing:
+		encoded = appendInteger(encoded, index, 6, headerFieldLiteralIncrementalIndex)
+	case RepresentationLiteralNeverIndexed:
+		encoded = appendInteger(encoded, index, 4, headerFieldLiteralNeverIndexed)
+	default:
+		encoded = appendInteger(encoded, index, 4, headerFieldLiteralNotIndexed)
+	}
+
+	if index == 0 {
+		encoded = appendLiteralString(encoded, header.Name, stringLengthPrefix, huffman)
+	}
+	encoded = appendLiteralString(encoded, header.Value, stringLengthPrefix, huffman)
+	return encoded, representation
+}
+
+// Updates the encoder's state for a header field rendered with renderHeaderField.
+func (encoder *Encoder) commitHeaderField(header Header, representation Representation, encodedLen int) error {
+	// the entry is added first, so the state is unchanged if it fails
+	if representation == RepresentationLiteralIncrementalIndexing {
+		if err := encoder.addNewDynamicEntry(header.Name, header.Value); err != nil {
+			return err
+		}
+	}
+	encoder.pendingDynamicTableSizeUpdate = false
+	if encoder.seenNames != nil {
+		encoder.seenNames[header.Name] = true
+	}
+	encoder.stats.UncompressedBytes += len(header.Name) + len(header.Value)
+	encoder.stats.EncodedBytes += encodedLen
+	switch representation {
+	case RepresentationIndexed:
+		encoder.stats.IndexedFields += 1
+	default:
+		encoder.stats.LiteralFields += 1
+	}
+	return nil
+}
+
+// A header field to encode with a representation and index chosen by the caller, see EncodePlanned.
+type FieldPlan struct {
+	// The representation of the header field, RepresentationDynamicTableSizeUpdate is not supported
+	Representation Representation
+	// For RepresentationIndexed the index of the entry in the static or dynamic table. For the
+	// literal representations the index of the entry whose name is used, or 0 to send Header.Name
+	// as a literal.
+	Index int
+	// The name and value of a literal, the name is only used when Index is 0
+	Header Header
+	// Whether the literal strings are Huffman encoded
+	Huffman bool
+}
+
+// Encodes header fields exactly as planned, without looking up the headers in the tables.
+// This allows a caller to build its own compression planner. Indices are relative to the
+// dynamic table at the point each field is encoded, so they shift after a field with
+// incremental indexing.
+//
+// An error is returned if a field references an index that doesn't exist or uses an
+// unsupported representation. The plan is checked before anything is encoded, so on
+// error the encoder's state is unchanged.
+func (encoder *Encoder) EncodePlanned(plan []FieldPlan) ([]byte, error) {
+	// run the plan against a copy first, the dynamic table is never modified in place
+	check := *encoder
+	check.onEvict = nil
+	check.seenNames = nil
+	if _, err := check.encodePlanned(plan); err != nil {
+		return nil, err
+	}
+	encoder.lastEncodeEvicted = 0
+	return encoder.encodePlanned(plan)
+}
+
+// Returns the name and value of the entry at index in the static or dynamic table.
+func (encoder *Encoder) getIndexedNameValue(index int) (string, string, error) {
+	if index <= 0 || index > len(encoder.staticTable)+len(encoder.dynamicTable) {
+		return "", "", fmt.Errorf("%w: index %d is out of range (%d static and %d dynamic entries)", ErrIndexNotFound, index, len(encoder.staticTable), len(encoder.dynamicTable))
+	}
+	if index > len(encoder.staticTable) {
+		entry := encoder.dynamicTable[index-len(encoder.staticTable)-1]
+		return entry.Name, entry.Value, nil
+	}
+	return encoder.staticTable[index-1][0], encoder.staticTable[index-1][1], nil
+}
+
+func (encoder *Encoder) encodePlanned(plan []FieldPlan) ([]byte, error) {
+	encoded := make([]byte, 0)
+	if encoder.pendingDynamicTableSizeUpdate && len(plan) > 0 {
+		encoded = encoder.appendPendingSizeUpdate(encoded)
+		encoder.stats.EncodedBytes += len(encoded)
+		encoder.pendingDynamicTableSizeUpdate = false
+	}
+
+	for _, field := range plan {
+		header := field.Header
+		header.Sensitive = false
+		if field.Index != 0 || field.Representation == RepresentationIndexed {
+			name, value, err := encoder.getIndexedNameValue(field.Index)
+			if err != nil {
+				return nil, err
+			}
+			header.Name = name
+			if field.Representation == RepresentationIndexed {
+				header.Value = value
+			}
+		}
+
+		var indexed []byte
+		switch field.Representation {
+		case RepresentationIndexed:
+			indexed = encodeInteger(field.Index, 7)
+			indexed[0] |= headerFieldIndexed
+		case RepresentationLiteralIncrementalIndexing:
+			indexed = encodeInteger(field.Index, 6)
+			indexed[0] |= headerFieldLiteralIncrementalIndex
+		case RepresentationLiteralNeverIndexed:
+			indexed = encodeInteger(field.Index, 4)
+			indexed[0] |= headerFieldLiteralNeverIndexed
+		case RepresentationLiteralNotIndexed:
+			indexed = encodeInteger(field.Index, 4)
+			indexed[0] |= headerFieldLiteralNotIndexed
+		default:
+			return nil, fmt.Errorf("can't encode a planned header field as %s", field.Representation)
+		}
+
+		fieldStart := len(encoded)
+		encoded = append(encoded, indexed...)
+		if field.Representation != RepresentationIndexed {
+			if field.Index == 0 {
+				encoded = append(encoded, encodeLiteralString(header.Name, stringLengthPrefix, field.Huffman)...)
+			}
+			encoded = append(encoded, encodeLiteralString(header.Value, stringLengthPrefix, field.Huffman)...)
+		}
+		if err := encoder.commitHeaderField(header, field.Representation, len(encoded)-fieldStart); err != nil {
+			return nil, err
+		}
 	}
+	return encoded, nil
+}
 
-	if length > decoder.stringLiteralLengthMax {
-		return buf, "", ErrStringLiteralLengthTooLong
+// Encodes headers into a header block like EncodeTrusted and also returns the offset in the
+// block where each header field starts, offsets[i] is the start of headers[i]. A pending dynamic
+// table size update is part of the first header field, so the offsets can be used to split the
+// block into the octets emitted for each header. Headers are validated if SetValidateHeaders is enabled,
+// all of them before anything is encoded, so on error the encoder's state is unchanged.
+func (encoder *Encoder) EncodeWithOffsets(headers []Header, huffman bool) (encoded []byte, offsets []int, err error) {
+	if err := encoder.checkHeaders(headers, encoder.validateHeaders); err != nil {
+		return nil, nil, err
 	}
-
-	if huffman&huffmanEncoded == huffmanEncoded {
-		if len(rest) < length {
-			return nil, "", fmt.Errorf("ran out of data while decoding huffman encoded data")
+	encoder.lastEncodeEvicted = 0
+	encoded = make([]byte, 0)
+	offsets = make([]int, 0, len(headers))
+	for _, header := range headers {
+		header, err := encoder.prepareHeader(header, encoder.validateHeaders)
+		if err != nil {
+			return nil, nil, err
 		}
-		decoded, err := HuffmanDecode(rest[:length])
+		offsets = append(offsets, len(encoded))
+		encoded, err = encoder.encodeHeaderField(encoded, header, huffman, true)
 		if err != nil {
-			return rest, "", err
+			return nil, nil, err
 		}
-		return rest[length:], string(decoded), nil
-	} else {
-		return rest[length:], string(rest[:length]), nil
 	}
+	return encoded, offsets, nil
 }
 
-func (decoder *Decoder) getIndexedNameValue(index int) (string, string, error) {
-	if index > len(staticTable) {
-		dynamicIndex := index - len(staticTable)
-		if dynamicIndex > len(decoder.dynamicTable) {
-			return "", "", fmt.Errorf("index %d not found in dynamic table", index)
+// Encodes headers into a header block like EncodeTrusted, but stops before the block
+// would be longer than maxBytes. The headers that didn't fit are returned so they can
+// be encoded into a following block, e.g. a CONTINUATION frame.
+//
+// The dynamic table only reflects the headers that were encoded. If the first header
+// doesn't fit, nothing is encoded and all headers are returned. Headers are validated
+// if SetValidateHeaders is enabled, all of them before anything is encoded, so on error
+// the encoder's state is unchanged.
+func (encoder *Encoder) EncodeWithBudget(headers []Header, maxBytes int, huffman bool) (encoded []byte, remaining []Header, err error) {
+	if err := encoder.checkHeaders(headers, encoder.validateHeaders); err != nil {
+		return nil, nil, err
+	}
+	encoder.lastEncodeEvicted = 0
+	encoded = make([]byte, 0)
+	for x, header := range headers {
+		header, err := encoder.prepareHeader(header, encoder.validateHeaders)
+		if err != nil {
+			return nil, nil, err
 		}
-		return decoder.dynamicTable[dynamicIndex-1].Name, decoder.dynamicTable[dynamicIndex-1].Value, nil
+		enc, representation := encoder.renderHeaderField(encoded, header, huffman, true)
+		if len(enc) > maxBytes {
+			// enc may share encoded's array, only octets past len(encoded) were written
+			return encoded, headers[x:], nil
+		}
+		if err := encoder.commitHeaderField(header, representation, len(enc)-len(encoded)); err != nil {
+			return nil, nil, err
+		}
+		encoded = enc
 	}
-	return staticTable[index-1][0], staticTable[index-1][1], nil
-}
-
-// Updates the decoder's dynamic table maximum size and evicts any
-// headers if more space is needed to resize to newMaxSize.
-func (decoder *Decoder) SetDynamicTableMaxSize(newMaxSize int) {
-	decoder.dynamicTableSizeMax = newMaxSize
-	decoder.evictEntries(0, newMaxSize)
-}
-
-// Sets the largest integer that is allowed, anything > value will result in an error
-func (decoder *Decoder) SetMaxIntegerValue(value int) {
-	decoder.integerValueMax = value
-}
-
-// Sets the maximum bytes allowed for encoding a single integer
-func (decoder *Decoder) SetMaxIntegerEncodedLength(length int) {
-	decoder.integerEncodedLengthMax = length
+	return encoded, nil, nil
 }
 
-// Sets the maximum length of a string literal
-// For compressed string literals the length check will be against the
-// compressed length, not the uncompressed length
-func (decoder *Decoder) SetMaxStringLiteralLength(length int) {
-	decoder.stringLiteralLengthMax = length
+func (encoder *Encoder) encode(headers []Header, huffman bool, validate bool) ([]byte, error) {
+	return encoder.encodeTo(make([]byte, 0), headers, huffman, validate)
 }
 
-// Finds the header in the table.
-// Returns the index and a bool indicating if the entry includes the value also.
-// If the entry wasn't found the index returned is -1
-func (encoder *Encoder) findHeaderInTable(name string, value string) (int, bool) {
-	var entry int
-	var ok bool
-
-	if value != "" {
-		entry, ok = staticTableEncodingWithValues[name+":"+value]
-		if ok {
-			return entry, true
-		}
+func (encoder *Encoder) encodeTo(dst []byte, headers []Header, huffman bool, validate bool) ([]byte, error) {
+	// an invalid header must not leave the headers before it in the dynamic table
+	if err := encoder.checkHeaders(headers, validate); err != nil {
+		return nil, err
 	}
-
-	for x, header := range encoder.dynamicTable {
-		if header.Name == name && header.Value == value {
-			return len(staticTable) + x + 1, true
+	encoder.lastEncodeEvicted = 0
+	encoded := dst
+	for _, header := range headers {
+		header, err := encoder.prepareHeader(header, validate)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err = encoder.encodeHeaderField(encoded, header, huffman, true)
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	entry, ok = staticTableEncoding[name]
-	if ok {
-		return entry, false
-	}
-	return -1, false
+	return encoded, nil
 }
 
-// Updates the encoder's dynamic table maximum size and evicts any
-// headers if more space is needed to resize to newMaxSize.
+// Parsers the HPACK header block and returns list of headers
+// with the order preserved from the order in the block.
 //
-// After this call the next header field that is encoded will include
-// a dynamic table size update
-func (encoder *Encoder) SetDynamicTableMaxSize(newMaxSize int) {
-	encoder.dynamicTableSizeMax = newMaxSize
-	encoder.evictEntries(0, newMaxSize)
-	encoder.pendingDynamicTableSizeUpdate = true
+// An empty block is a valid header block with no header fields and results in an
+// empty list, unless SetRejectEmptyBlock is enabled. A block that only contains
+// dynamic table size updates also results in an empty list.
+func (decoder *Decoder) Decode(block []byte) ([]Header, error) {
+	return decoder.DecodeReuse(block, make([]Header, 0))
 }
 
-func findStaticEntryInTable(name string) int {
-	entry, ok := staticTableEncoding[name]
-	if ok {
-		return entry
-	}
-	return -1
+// Parses the HPACK header block like Decode, but appends the headers to dst
+// after truncating it to zero length. The returned slice should be used in place of dst.
+//
+// This allows the caller to reuse the same slice (e.g. from a sync.Pool) across
+// header blocks to avoid allocating a new slice for each block.
+func (decoder *Decoder) DecodeReuse(block []byte, dst []Header) ([]Header, error) {
+	return decoder.decode(context.Background(), block, dst[:0])
 }
 
-// This is a convenience function that encodes a list of headers
-// into a header block using Huffman compression and with incremental
-// indexing enabled.
+// Parses the HPACK header block like Decode, but aborts with the context's error
+// if the context is done. The context is checked before the first header field and
+// then periodically while parsing, so decoding can be bounded by a deadline.
 //
-// If a header is marked as Sensitive it will be encoded as a
-// never indexed header field
-func (encoder *Encoder) Encode(headers []Header) ([]byte, error) {
-	return encoder.encode(headers, true)
+// The header fields parsed before the context is done have already updated the dynamic
+// table, so after the context's error is returned for a partially decoded block the table
+// is out of sync with the encoder, like after any other decoding error, and the decoder
+// can't be used to decode the following blocks of the connection.
+func (decoder *Decoder) DecodeContext(ctx context.Context, block []byte) ([]Header, error) {
+	return decoder.decode(ctx, block, make([]Header, 0))
 }
 
-func encodeLiteralString(str string, prefixLength int, huffman bool) []byte {
-	encoded := make([]byte, 0)
+// Parses the HPACK header block like Decode and also returns the dynamic table size updates
+// and the number of evictions that happened while decoding it. On error the info describes
+// the part of the block that was decoded.
+func (decoder *Decoder) DecodeWithInfo(block []byte) ([]Header, DecodeInfo, error) {
+	info := DecodeInfo{}
+	decoder.info = &info
+	defer func() { decoder.info = nil }()
+	headers, err := decoder.Decode(block)
+	return headers, info, err
+}
 
-	var value []byte
-	if huffman {
-		value = HuffmanEncode([]byte(str))
-	} else {
-		value = []byte(str)
+// Parses the HPACK header block like Decode and groups the values by header name, the
+// values of a name are in the order they appear in the block.
+//
+// The order of fields with different names and whether a field was Sensitive is lost,
+// use Decode when either matters.
+func (decoder *Decoder) DecodeToMap(block []byte) (map[string][]string, error) {
+	headers, err := decoder.Decode(block)
+	if err != nil {
+		return nil, err
 	}
-	valueLen := encodeInteger(len(value), prefixLength)
-
-	if huffman {
-		valueLen[0] |= huffmanEncoded
+	values := make(map[string][]string)
+	for _, header := range headers {
+		values[header.Name] = append(values[header.Name], header.Value)
 	}
-	encoded = append(encoded, valueLen...)
-	encoded = append(encoded, value...)
-	return encoded
+	return values, nil
 }
 
-// Encodes a header without Indexing and returns the encoded header field
-//
-// https://tools.ietf.org/html/rfc7541#appendix-C.2.2
-func (encoder *Encoder) EncodeNoDynamicIndexing(header Header, huffman bool) ([]byte, error) {
-	return encoder.encodeHeaderField(header, huffman, false)
+// Parses the HPACK header block like Decode and updates the decoder's dynamic table,
+// but discards the headers. This keeps the decoder in sync when a block is forwarded
+// unchanged, e.g. by a proxy.
+func (decoder *Decoder) Advance(block []byte) error {
+	_, err := decoder.decodeWith(context.Background(), block, nil, func(encoded []byte) ([]byte, *Header, error) {
+		rest, _, err := decoder.parseHeaderField(encoded)
+		return rest, nil, err
+	})
+	return err
 }
 
-// Encodes a header with Indexing and returns the encoded header field
+// Checks that the HPACK header block is well formed without changing the decoder's dynamic
+// table: integers and indices must be valid, string literals complete and Huffman codes
+// valid, with the same limits as Decode. Out of range indices are errors even with
+// SetLenientIndexErrors. The block is checked against the current dynamic
+// table, so a block that is valid now may not be valid after another block was decoded.
 //
-// https://tools.ietf.org/html/rfc7541#appendix-C.2.1
-func (encoder *Encoder) EncodeIndexed(header Header, huffman bool) ([]byte, error) {
-	return encoder.encodeHeaderField(header, huffman, true)
+// No headers are returned, the callbacks, tracer and interner are not called. String literals are
+// still decoded, as the sizes of inserted entries decide which entries are evicted.
+func (decoder *Decoder) Validate(block []byte) error {
+	// the dynamic table is never modified in place, inserts and evictions on
+	// the copy replace its slice
+	validator := *decoder
+	validator.onEvict = nil
+	validator.onInsert = nil
+	validator.tracer = nil
+	validator.lenientIndexErrors = false
+	validator.info = nil
+	validator.interner = nil
+	_, err := validator.decodeWith(context.Background(), block, nil, func(encoded []byte) ([]byte, *Header, error) {
+		rest, _, err := validator.parseHeaderField(encoded)
+		return rest, nil, err
+	})
+	return err
 }
 
-func (encoder *Encoder) encodeHeaderField(header Header, huffman bool, addDynamicIndex bool) ([]byte, error) {
-	encoded := make([]byte, 0)
-
-	if encoder.pendingDynamicTableSizeUpdate {
-		newSize := encodeInteger(encoder.dynamicTableSizeMax, 5)
-		newSize[0] |= headerFieldDynamicSizeUpdate
-		encoded = append(encoded, newSize...)
-		encoder.pendingDynamicTableSizeUpdate = false
-	}
-
-	if header.Sensitive {
-		index := findStaticEntryInTable(header.Name)
-		if index != -1 {
-			indexed := encodeInteger(index, 4)
-			indexed[0] |= headerFieldLiteralNeverIndexed
-			encoded = append(encoded, indexed...)
-		} else {
-			indexed := encodeInteger(0, 4)
-			indexed[0] |= headerFieldLiteralNeverIndexed
-			encoded = append(encoded, indexed...)
-			encoded = append(encoded, encodeLiteralString(header.Name, 7, huffman)...)
-		}
+// Size of the reads done by DecodeFromReader
+const decodeReaderChunkSize = 4096
 
-		encoded = append(encoded, encodeLiteralString(header.Value, 7, huffman)...)
-	} else {
-		index, valueIndexed := encoder.findHeaderInTable(header.Name, header.Value)
-		if index != -1 && valueIndexed {
-			indexed := encodeInteger(index, 7)
-			indexed[0] |= headerFieldIndexed
-			encoded = append(encoded, indexed...)
-		} else {
-			var indexed []byte
-			if index == -1 {
-				indexed = encodeInteger(0, 6)
-			} else {
-				indexed = encodeInteger(index, 6)
+// Parses an HPACK header block read from r until it returns io.EOF, calling emit with each
+// header in the order they are in the block. Only a header field that has been partially
+// read is buffered, so the whole block doesn't have to be in memory, and a header field
+// may be split across any number of reads. A string literal skipped with PolicySkip is
+// discarded as it is read, so it isn't buffered either.
+//
+// Decoding stops at the first error returned by r, other than io.EOF, or by emit. If r
+// ends in the middle of a header field, ErrIntegerTruncated or ErrStringLiteralTruncated
+// is returned. The headers that were emitted before an error have been added to the
+// dynamic table as they are with Decode.
+func (decoder *Decoder) DecodeFromReader(r io.Reader, emit func(Header) error) error {
+	var pending []byte
+	chunk := make([]byte, decodeReaderChunkSize)
+	regularSeen := false
+	read := 0
+	// octets of a string literal skipped by the oversize string policy that haven't been read yet,
+	// and whether the value of a header field whose name was skipped follows them
+	discard := 0
+	skippedValue := false
+	for {
+		n, readErr := r.Read(chunk)
+		read += n
+		buf := append(pending, chunk[:n]...)
+
+		var parseErr error
+		for len(buf) > 0 {
+			if discard > 0 {
+				skipped := min(discard, len(buf))
+				buf = buf[skipped:]
+				discard -= skipped
+				continue
 			}
 
-			if addDynamicIndex {
-				indexed[0] |= headerFieldLiteralIncrementalIndex
-				encoder.addNewDynamicEntry(header.Name, header.Value)
+			var rest []byte
+			var header *Header
+			if skippedValue {
+				rest, _, _, parseErr = decoder.readSkippableString(buf)
 			} else {
-				indexed[0] |= headerFieldLiteralNotIndexed
+				// a truncated header field fails before the decoder's state is changed,
+				// so it can be parsed again once more data has been read
+				rest, header, parseErr = decoder.parseHeaderField(buf)
 			}
-
-			encoded = append(encoded, indexed...)
-			if index == -1 {
-				encoded = append(encoded, encodeLiteralString(header.Name, 7, huffman)...)
+			if errors.Is(parseErr, ErrIntegerTruncated) || errors.Is(parseErr, ErrStringLiteralTruncated) {
+				// an oversize string literal that is skipped is discarded as it is read
+				// instead of waiting for all of it
+				consumed, length, valueFollows, ok := decoder.skipTruncatedLiteral(buf, skippedValue)
+				if !ok {
+					break
+				}
+				buf = buf[consumed:]
+				discard = length
+				skippedValue = valueFollows
+				continue
+			} else if parseErr != nil {
+				return parseErr
+			}
+			if len(rest) >= len(buf) {
+				return ErrDecodeStalled
 			}
+			buf = rest
+			skippedValue = false
+			if header != nil {
+				if err := decoder.checkPseudoHeader(header, &regularSeen); err != nil {
+					return err
+				}
+				if err := emit(*header); err != nil {
+					return err
+				}
+			}
+		}
+		pending = append(pending[:0], buf...)
 
-			encoded = append(encoded, encodeLiteralString(header.Value, 7, huffman)...)
+		if readErr == io.EOF {
+			if len(pending) > 0 {
+				return parseErr
+			}
+			if discard > 0 || skippedValue {
+				return ErrStringLiteralTruncated
+			}
+			if read == 0 && decoder.rejectEmptyBlock {
+				return ErrEmptyBlock
+			}
+			return nil
+		} else if readErr != nil {
+			return readErr
 		}
 	}
-	return encoded, nil
 }
 
-func (encoder *Encoder) encode(headers []Header, huffman bool) ([]byte, error) {
-	encoded := make([]byte, 0)
-	for _, header := range headers {
-		enc, err := encoder.EncodeIndexed(header, huffman)
+// Number of header fields parsed between checks of the context in DecodeContext
+const decodeContextCheckInterval = 32
+
+func (decoder *Decoder) decode(ctx context.Context, block []byte, headers []Header) ([]Header, error) {
+	return decoder.decodeWith(ctx, block, headers, decoder.parseHeaderField)
+}
+
+// Decodes the header block using parse to parse each header field. Every header field
+// must consume data, otherwise decoding fails with ErrDecodeStalled instead of looping forever.
+func (decoder *Decoder) decodeWith(ctx context.Context, block []byte, headers []Header, parse func([]byte) ([]byte, *Header, error)) ([]Header, error) {
+	if len(block) == 0 && decoder.rejectEmptyBlock {
+		return nil, ErrEmptyBlock
+	}
+	buf := block
+	regularSeen := false
+	for fields := 0; len(buf) > 0; fields++ {
+		var header *Header
+		var err error
+
+		if fields%decodeContextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		var rest []byte
+		rest, header, err = parse(buf)
 		if err != nil {
 			return nil, err
 		}
-		encoded = append(encoded, enc...)
+		if len(rest) >= len(buf) {
+			return nil, ErrDecodeStalled
+		}
+		buf = rest
+		if header != nil {
+			if err = decoder.checkPseudoHeader(header, &regularSeen); err != nil {
+				return nil, err
+			}
+			headers = append(headers, *header)
+		}
 	}
-	return encoded, nil
+	return headers, nil
 }
 
-// Parsers the HPACK header block and returns list of headers
-// with the order preserved from the order in the block.
-func (decoder *Decoder) Decode(block []byte) ([]Header, error) {
-	headers := make([]Header, 0)
+// Parses the HPACK header block like Decode, but also returns the representation
+// each header field was encoded with.
+func (decoder *Decoder) DecodeFields(block []byte) ([]HeaderField, error) {
+	if len(block) == 0 && decoder.rejectEmptyBlock {
+		return nil, ErrEmptyBlock
+	}
+	fields := make([]HeaderField, 0)
 	buf := block
+	regularSeen := false
 	for len(buf) > 0 {
 		var header *Header
 		var err error
 
-		buf, header, err = decoder.parseHeaderField(buf)
+		representation := representationOf(buf[0])
+		decoder.lastRawString = nil
+		var rest []byte
+		rest, header, err = decoder.parseHeaderField(buf)
 		if err != nil {
 			return nil, err
 		}
+		if len(rest) >= len(buf) {
+			return nil, ErrDecodeStalled
+		}
+		buf = rest
 		if header != nil {
-			headers = append(headers, *header)
+			if err = decoder.checkPseudoHeader(header, &regularSeen); err != nil {
+				return nil, err
+			}
+			field := HeaderField{Header: *header, Representation: representation}
+			if decoder.captureRawValues && representation != RepresentationIndexed {
+				// the value is always the last string literal in a field
+				field.RawValue, field.ValueHuffman = decoder.lastRawString, decoder.lastStringHuffman
+			}
+			fields = append(fields, field)
 		}
 	}
-	return headers, nil
+	return fields, nil
+}
+
+// Parses a single header field from the start of block, returning the remaining
+// bytes and the header. This allows a header block to be stepped through one field
+// at a time, the decoder's dynamic table is updated just as it is with Decode.
+//
+// A nil header with a nil error is returned when a dynamic table size update was
+// consumed, or a header field was skipped because of the oversize string policy or
+// SetLenientIndexErrors.
+// An empty block results in ErrEmptyBlock. If an indexed header field references an index
+// that isn't in the tables, the error wraps ErrIndexNotFound and rest starts after the field.
+func (decoder *Decoder) DecodeField(block []byte) (rest []byte, header *Header, err error) {
+	if len(block) == 0 {
+		return nil, nil, ErrEmptyBlock
+	}
+	return decoder.parseHeaderField(block)
 }
 
-// Returns true if there is enough space to accomadate additionalSize
-func (encoder *Encoder) evictEntries(additionalSize int, maxSize int) bool {
+// Returns true if there is enough space to accomadate additionalSize. The size of the table
+// is checked with checkBeforeEviction first, so ErrDynamicTableSizeInconsistent is returned
+// before anything is evicted.
+func (encoder *Encoder) evictEntries(additionalSize int, maxSize int) (bool, error) {
+	if err := encoder.checkBeforeEviction(additionalSize, maxSize); err != nil {
+		return false, err
+	}
 	for encoder.dynamicTableSizeCurrent+additionalSize > maxSize {
 		if len(encoder.dynamicTable) == 0 {
-			return false
+			return false, nil
 		}
 
 		evictedEntry := encoder.dynamicTable[len(encoder.dynamicTable)-1]
-		encoder.dynamicTableSizeCurrent -= (32 + len(evictedEntry.Name) + len(evictedEntry.Value))
+		encoder.dynamicTableSizeCurrent -= encoder.entrySizeOf(evictedEntry.Name, evictedEntry.Value)
 		encoder.dynamicTable = encoder.dynamicTable[:len(encoder.dynamicTable)-1]
+		if encoder.onEvict != nil {
+			encoder.onEvict(evictedEntry)
+		}
 	}
-	return true
+	return true, nil
 }
 
-// Returns true if there is enough space to accomadate additionalSize
-func (decoder *Decoder) evictEntries(additionalSize int, maxSize int) bool {
+// Returns true if there is enough space to accomadate additionalSize, see Encoder.evictEntries.
+func (decoder *Decoder) evictEntries(additionalSize int, maxSize int) (bool, error) {
+	if err := decoder.checkBeforeEviction(additionalSize, maxSize); err != nil {
+		return false, err
+	}
 	for decoder.dynamicTableSizeCurrent+additionalSize > maxSize {
 		if len(decoder.dynamicTable) == 0 {
-			return false
+			return false, nil
 		}
 
 		evictedEntry := decoder.dynamicTable[len(decoder.dynamicTable)-1]
-		decoder.dynamicTableSizeCurrent -= (32 + len(evictedEntry.Name) + len(evictedEntry.Value))
+		decoder.dynamicTableSizeCurrent -= decoder.entrySizeOf(evictedEntry.Name, evictedEntry.Value)
 		decoder.dynamicTable = decoder.dynamicTable[:len(decoder.dynamicTable)-1]
+		if decoder.onEvict != nil {
+			decoder.onEvict(evictedEntry)
+		}
+		if decoder.tracer != nil {
+			decoder.tracer(DecodeEvent{Type: EventEviction, Header: evictedEntry})
+		}
+		if decoder.info != nil {
+			decoder.info.Evictions += 1
+		}
+	}
+	return true, nil
+}
+
+// Returns the size of the entries in the dynamic table.
+func (encoder *Encoder) dynamicTableEntriesSize() int {
+	size := 0
+	for _, entry := range encoder.dynamicTable {
+		size += encoder.entrySizeOf(entry.Name, entry.Value)
+	}
+	return size
+}
+
+// Returns the size of the entries in the dynamic table.
+func (decoder *Decoder) dynamicTableEntriesSize() int {
+	size := 0
+	for _, entry := range decoder.dynamicTable {
+		size += decoder.entrySizeOf(entry.Name, entry.Value)
+	}
+	return size
+}
+
+// Checks the size of the dynamic table with CheckDynamicTableSize if entries have to be
+// evicted to make room for additionalSize, or if the size is negative.
+func (encoder *Encoder) checkBeforeEviction(additionalSize int, maxSize int) error {
+	if encoder.dynamicTableSizeCurrent < 0 || encoder.dynamicTableSizeCurrent+additionalSize > maxSize {
+		return encoder.CheckDynamicTableSize()
 	}
-	return true
+	return nil
 }
 
-func (encoder *Encoder) addNewDynamicEntry(name string, value string) {
-	entrySize := (32 + len(name) + len(value))
+// Returns ErrDynamicTableSizeInconsistent if the incrementally maintained size of the
+// dynamic table doesn't match the size of its entries. The size is checked before the
+// table is changed, so an accounting error is reported instead of being corrected.
+func (encoder *Encoder) CheckDynamicTableSize() error {
+	if size := encoder.dynamicTableEntriesSize(); size != encoder.dynamicTableSizeCurrent {
+		return dynamicTableSizeInconsistent(encoder.dynamicTableSizeCurrent, size, len(encoder.dynamicTable))
+	}
+	return nil
+}
+
+// Checks the size of the dynamic table with CheckDynamicTableSize if entries have to be
+// evicted to make room for additionalSize, or if the size is negative.
+func (decoder *Decoder) checkBeforeEviction(additionalSize int, maxSize int) error {
+	if decoder.dynamicTableSizeCurrent < 0 || decoder.dynamicTableSizeCurrent+additionalSize > maxSize {
+		return decoder.CheckDynamicTableSize()
+	}
+	return nil
+}
+
+// Returns ErrDynamicTableSizeInconsistent if the incrementally maintained size of the
+// dynamic table doesn't match the size of its entries. The size is checked before the
+// table is changed, so an accounting error is reported instead of being corrected.
+func (decoder *Decoder) CheckDynamicTableSize() error {
+	if size := decoder.dynamicTableEntriesSize(); size != decoder.dynamicTableSizeCurrent {
+		return dynamicTableSizeInconsistent(decoder.dynamicTableSizeCurrent, size, len(decoder.dynamicTable))
+	}
+	return nil
+}
 
-	if !encoder.evictEntries(entrySize, encoder.dynamicTableSizeMax) {
-		return
+func dynamicTableSizeInconsistent(size int, entriesSize int, entries int) error {
+	return fmt.Errorf("%w: size is %d but the %d entries have a size of %d", ErrDynamicTableSizeInconsistent, size, entries, entriesSize)
+}
+
+// Returns ErrDynamicTableSizeInconsistent if the size of the table doesn't match its entries.
+func (encoder *Encoder) addNewDynamicEntry(name string, value string) error {
+	entrySize := encoder.entrySizeOf(name, value)
+
+	entries := len(encoder.dynamicTable)
+	fits, err := encoder.evictEntries(entrySize, encoder.dynamicTableSizeMax)
+	encoder.lastEncodeEvicted += entries - len(encoder.dynamicTable)
+	if !fits {
+		return err
 	}
 	encoder.dynamicTableSizeCurrent += entrySize
 
@@ -354,13 +1835,15 @@ func (encoder *Encoder) addNewDynamicEntry(name string, value string) {
 			Value: value,
 		},
 	}, encoder.dynamicTable...)
+	return nil
 }
 
-func (decoder *Decoder) addNewDynamicEntry(name string, value string) {
-	entrySize := (32 + len(name) + len(value))
+// Returns ErrDynamicTableSizeInconsistent if the size of the table doesn't match its entries.
+func (decoder *Decoder) addNewDynamicEntry(name string, value string) error {
+	entrySize := decoder.entrySizeOf(name, value)
 
-	if !decoder.evictEntries(entrySize, decoder.dynamicTableSizeMax) {
-		return
+	if fits, err := decoder.evictEntries(entrySize, decoder.dynamicTableSizeMax); !fits {
+		return err
 	}
 	decoder.dynamicTableSizeCurrent += entrySize
 
@@ -370,6 +1853,10 @@ func (decoder *Decoder) addNewDynamicEntry(name string, value string) {
 			Value: value,
 		},
 	}, decoder.dynamicTable...)
+	if decoder.onInsert != nil {
+		decoder.onInsert(decoder.dynamicTable[0])
+	}
+	return nil
 }
 
 func (decoder *Decoder) parseHeaderFieldIndexed(encoded []byte) ([]byte, *Header, error) {
@@ -380,9 +1867,20 @@ func (decoder *Decoder) parseHeaderFieldIndexed(encoded []byte) ([]byte, *Header
 
 	name, value, err := decoder.getIndexedNameValue(index)
 	if err != nil {
-		return nil, nil, err
+		if !decoder.lenientIndexErrors {
+			// the field itself was parsed, so the caller can tell where the next one starts
+			return rest, nil, err
+		}
+		if decoder.tracer != nil {
+			decoder.tracer(DecodeEvent{Type: EventSkippedIndex, Representation: RepresentationIndexed, Index: index})
+		}
+		return rest, nil, nil
+	}
+	header := &Header{Name: name, Value: value}
+	if decoder.tracer != nil {
+		decoder.tracer(DecodeEvent{Type: EventIndexedField, Header: *header, Representation: RepresentationIndexed, Index: index})
 	}
-	return rest, &Header{Name: name, Value: value}, nil
+	return rest, header, nil
 }
 
 func (decoder *Decoder) parseHeaderFieldIncrementalIndex(encoded []byte) ([]byte, *Header, error) {
@@ -393,10 +1891,13 @@ func (decoder *Decoder) parseHeaderFieldIncrementalIndex(encoded []byte) ([]byte
 
 	var name string
 	if index == 0 {
-		rest, name, err = decoder.readPrefixedLengthString(rest, 7)
+		rest, name, err = decoder.readPrefixedLengthString(rest, stringLengthPrefix)
 		if err != nil {
 			return nil, nil, err
 		}
+		if name == "" && decoder.rejectEmptyNames {
+			return nil, nil, ErrEmptyHeaderName
+		}
 	} else {
 		name, _, err = decoder.getIndexedNameValue(index)
 		if err != nil {
@@ -404,13 +1905,23 @@ func (decoder *Decoder) parseHeaderFieldIncrementalIndex(encoded []byte) ([]byte
 		}
 	}
 
-	rest, value, err := decoder.readPrefixedLengthString(rest, 7)
+	rest, value, err := decoder.readPrefixedLengthString(rest, stringLengthPrefix)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	decoder.addNewDynamicEntry(name, value)
-	return rest, &Header{Name: name, Value: value}, nil
+	// the field is only traced once inserting it can't fail
+	if err := decoder.checkBeforeEviction(decoder.entrySizeOf(name, value), decoder.dynamicTableSizeMax); err != nil {
+		return nil, nil, err
+	}
+	header := &Header{Name: name, Value: value}
+	if decoder.tracer != nil {
+		decoder.tracer(DecodeEvent{Type: EventLiteralField, Header: *header, Representation: RepresentationLiteralIncrementalIndexing, Index: index})
+	}
+	if err := decoder.addNewDynamicEntry(name, value); err != nil {
+		return nil, nil, err
+	}
+	return rest, header, nil
 }
 
 func (decoder *Decoder) parseDynamicSizeUpdate(encoded []byte) ([]byte, error) {
@@ -418,68 +1929,187 @@ func (decoder *Decoder) parseDynamicSizeUpdate(encoded []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if size > decoder.dynamicTableSizeMax {
-		return consumed, fmt.Errorf("can't resize dynamic table to %d in an update to a value greater than the current size, %d", size, decoder.dynamicTableSizeCurrent)
+	if size > decoder.dynamicTableSizeLimit {
+		return nil, fmt.Errorf("%w: can't resize dynamic table to %d in an update to a value greater than the maximum size, %d", ErrDynamicTableSizeTooLarge, size, decoder.dynamicTableSizeLimit)
+	}
+	if err := decoder.CheckDynamicTableSize(); err != nil {
+		return nil, err
+	}
+	if decoder.tracer != nil {
+		decoder.tracer(DecodeEvent{Type: EventSizeUpdate, Representation: RepresentationDynamicTableSizeUpdate, Size: size})
+	}
+	if decoder.info != nil {
+		decoder.info.SizeUpdatesApplied = append(decoder.info.SizeUpdatesApplied, size)
+	}
+	if err := decoder.resizeDynamicTable(size); err != nil {
+		return nil, err
 	}
-	decoder.SetDynamicTableMaxSize(size)
 	return consumed, nil
 }
 
-func (decoder *Decoder) parseHeaderFieldNotIndexed(encoded []byte) ([]byte, *Header, error) {
+// Parses a literal header field without indexing, or never indexed if representation
+// is RepresentationLiteralNeverIndexed, which is decoded as a Sensitive header.
+func (decoder *Decoder) parseHeaderFieldNotIndexed(encoded []byte, representation Representation) ([]byte, *Header, error) {
 	rest, _, index, err := decoder.DecodeInteger(encoded, 4)
 	if err != nil {
 		return nil, nil, err
 	}
+
+	var name string
+	var nameSkipped bool
 	if index == 0 {
-		rest, name, err := decoder.readPrefixedLengthString(rest, 7)
+		rest, name, nameSkipped, err = decoder.readSkippableString(rest)
 		if err != nil {
 			return nil, nil, err
 		}
-
-		rest, value, err := decoder.readPrefixedLengthString(rest, 7)
+	} else {
+		name, _, err = decoder.getIndexedNameValue(index)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
 
-		return rest, &Header{Name: name, Value: value}, nil
+	rest, value, valueSkipped, err := decoder.readSkippableString(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nameSkipped || valueSkipped {
+		return rest, nil, nil
+	}
+	header := &Header{Name: name, Value: value, Sensitive: representation == RepresentationLiteralNeverIndexed}
+	if decoder.tracer != nil {
+		decoder.tracer(DecodeEvent{Type: EventLiteralField, Header: *header, Representation: representation, Index: index})
+	}
+	return rest, header, nil
+}
 
-	} else {
-		name, _, err := decoder.getIndexedNameValue(index)
-		if err != nil {
-			return nil, nil, err
-		}
+// Reads a string literal with a 7 bit length prefix like readPrefixedLengthString, but if the
+// string is too long and the oversize string policy is PolicySkip, the string is skipped and
+// true is returned instead of ErrStringLiteralLengthTooLong.
+func (decoder *Decoder) readSkippableString(buf []byte) ([]byte, string, bool, error) {
+	rest, str, err := decoder.readPrefixedLengthString(buf, stringLengthPrefix)
+	if err != ErrStringLiteralLengthTooLong || decoder.oversizeStringPolicy != PolicySkip {
+		return rest, str, false, err
+	}
+	rest, _, length, err := decoder.DecodeInteger(buf, stringLengthPrefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if len(rest) < length {
+		return nil, "", false, ErrStringLiteralTruncated
+	}
+	return rest[length:], "", true, nil
+}
 
-		rest, value, err := decoder.readPrefixedLengthString(rest, 7)
-		if err != nil {
-			return nil, nil, err
+// Returns how a truncated literal header field at the start of buf, or the value string of a
+// field whose name was skipped if valueOnly is true, is discarded when a string literal in it is
+// skipped by the oversize string policy: the number of octets up to the skipped string, the length
+// of the string and whether the value string of the field follows it. ok is false if no string is
+// skipped or more data is needed to know.
+func (decoder *Decoder) skipTruncatedLiteral(buf []byte, valueOnly bool) (consumed int, length int, valueFollows bool, ok bool) {
+	if decoder.oversizeStringPolicy != PolicySkip {
+		return 0, 0, false, false
+	}
+	rest := buf
+	if !valueOnly {
+		representation := representationOf(buf[0])
+		if representation != RepresentationLiteralNotIndexed && representation != RepresentationLiteralNeverIndexed {
+			return 0, 0, false, false
+		}
+		var index int
+		var err error
+		if rest, _, index, err = decoder.DecodeInteger(buf, 4); err != nil {
+			return 0, 0, false, false
+		}
+		if index == 0 {
+			if prefix, length, ok := decoder.oversizeStringPrefix(rest); ok {
+				return len(buf) - len(rest) + prefix, length, true, true
+			}
+			if rest, _, err = decoder.readPrefixedLengthString(rest, stringLengthPrefix); err != nil {
+				return 0, 0, false, false
+			}
 		}
+	}
+	prefix, length, ok := decoder.oversizeStringPrefix(rest)
+	if !ok {
+		return 0, 0, false, false
+	}
+	return len(buf) - len(rest) + prefix, length, false, true
+}
+
+// Returns the length of the length prefix of the string literal at the start of buf and the
+// length of the string, if it is too long for the limits and is known to be skipped before
+// the string has been read.
+func (decoder *Decoder) oversizeStringPrefix(buf []byte) (int, int, bool) {
+	if len(buf) == 0 {
+		return 0, 0, false
+	}
+	rest, huffman, length, err := decoder.DecodeInteger(buf, stringLengthPrefix)
+	if err != nil {
+		return 0, 0, false
+	}
+	// the decoded length of a Huffman encoded string is only known once it is decoded
+	if length > decoder.stringLiteralLengthMax ||
+		(huffman&huffmanEncoded == 0 && length > decoder.decodedStringLengthMax) {
+		return len(buf) - len(rest), length, true
+	}
+	return 0, 0, false
+}
 
-		return rest, &Header{Name: name, Value: value}, nil
+// Returns the representation of a header field from its first octet.
+//
+// The representations are identified by a variable length pattern in the high bits,
+// so the checks must be done from the longest prefix to the shortest, with each
+// check relying on the previous ones having failed:
+//
+//	1xxxxxxx indexed
+//	01xxxxxx literal with incremental indexing
+//	001xxxxx dynamic table size update
+//	0001xxxx literal never indexed
+//	0000xxxx literal without indexing
+//
+// For example 0x3f (00111111) is a dynamic table size update even though it has the bit
+// for literal with incremental indexing in its prefix value, because that bit is only
+// tested after the high bit.
+func representationOf(b byte) Representation {
+	if b&headerFieldIndexed == headerFieldIndexed {
+		return RepresentationIndexed
+	} else if b&headerFieldLiteralIncrementalIndex == headerFieldLiteralIncrementalIndex {
+		return RepresentationLiteralIncrementalIndexing
+	} else if b&headerFieldDynamicSizeUpdate == headerFieldDynamicSizeUpdate {
+		return RepresentationDynamicTableSizeUpdate
+	} else if b&headerFieldLiteralNeverIndexed == headerFieldLiteralNeverIndexed {
+		return RepresentationLiteralNeverIndexed
 	}
+	return RepresentationLiteralNotIndexed
 }
 
+// Returns the representation of a header field from the first octet of the field,
+// without decoding the rest of the field. See representationOf for how the octet is matched.
+func PeekRepresentation(b byte) Representation {
+	return representationOf(b)
+}
+
+// Parses a single header field from encoded, returning the remaining buffer and the
+// header. A nil header is returned for a dynamic table size update or a skipped header field.
+//
+// On error the header is always nil. The remaining buffer is nil too, except for an indexed
+// header field with an index that isn't in the tables, where it starts after the field.
 func (decoder *Decoder) parseHeaderField(encoded []byte) ([]byte, *Header, error) {
-	if encoded[0]&headerFieldIndexed == headerFieldIndexed {
+	switch representationOf(encoded[0]) {
+	case RepresentationIndexed:
 		return decoder.parseHeaderFieldIndexed(encoded)
-	} else if encoded[0]&headerFieldLiteralIncrementalIndex == headerFieldLiteralIncrementalIndex {
+	case RepresentationLiteralIncrementalIndexing:
 		return decoder.parseHeaderFieldIncrementalIndex(encoded)
-	} else if encoded[0]&headerFieldDynamicSizeUpdate == headerFieldDynamicSizeUpdate {
+	case RepresentationDynamicTableSizeUpdate:
 		rest, err := decoder.parseDynamicSizeUpdate(encoded)
 		if err != nil {
-			return rest, nil, err
+			return nil, nil, err
 		}
 		return rest, nil, nil
-	} else if encoded[0]&headerFieldLiteralNeverIndexed == headerFieldLiteralNeverIndexed {
-		rest, header, err := decoder.parseHeaderFieldNotIndexed(encoded)
-		if err != nil {
-			return rest, header, err
-		} else {
-			header.Sensitive = true
-			return rest, header, err
-		}
-	} else if encoded[0]&headerFieldLiteralNotIndexed == headerFieldLiteralNotIndexed {
-		return decoder.parseHeaderFieldNotIndexed(encoded)
-	} else {
-		panic(fmt.Errorf("unknown type: %02x", encoded[0]))
+	case RepresentationLiteralNeverIndexed:
+		return decoder.parseHeaderFieldNotIndexed(encoded, RepresentationLiteralNeverIndexed)
+	default:
+		return decoder.parseHeaderFieldNotIndexed(encoded, RepresentationLiteralNotIndexed)
 	}
 }
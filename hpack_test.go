@@ -1,9 +1,18 @@
 package hpack
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestExampleC11ParseInteger(t *testing.T) {
@@ -48,6 +57,189 @@ func TestExampleC13ParseWrite(t *testing.T) {
 	assert.Equal(t, []byte{42}, encodeInteger(42, 8))
 }
 
+func TestDecodeLargeInteger(t *testing.T) {
+	decoder := NewDecoder(256)
+	decoder.SetMaxIntegerValue(1 << 62)
+	decoder.SetMaxIntegerEncodedLength(10)
+
+	for _, value := range []int{1 << 32, 1 << 40, 1 << 62} {
+		_, _, decoded, err := decoder.DecodeInteger(encodeInteger(value, 5), 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, decoded)
+	}
+
+	_, _, _, err := decoder.DecodeInteger(encodeInteger((1<<62)+1, 5), 5)
+	assert.Equal(t, ErrIntegerValueTooLarge, err)
+}
+
+func TestDecodeIntegerDefaultMax(t *testing.T) {
+	decoder := NewDecoder(256)
+	_, _, decoded, err := decoder.DecodeInteger(encodeInteger(DefaultMaxIntegerValue, 5), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DefaultMaxIntegerValue, decoded)
+
+	_, _, _, err = decoder.DecodeInteger(encodeInteger(1<<32, 5), 5)
+	assert.Equal(t, ErrIntegerValueTooLarge, err)
+}
+
+func TestDynamicSizeUpdateOverflow(t *testing.T) {
+	decoder := NewDecoder(4096)
+	decoder.SetMaxIntegerValue(maxInt)
+	decoder.SetMaxIntegerEncodedLength(16)
+	decoder.ApplySettings(maxInt)
+	decoder.SetDynamicTableMaxSize(maxInt)
+	_, err := decoder.Decode([]byte{0x40, 0x01, 'a', 0x01, 'b'})
+	assert.Nil(t, err)
+
+	// the size would be 2^64+30 on 64-bit platforms, which wraps around in an int
+	encoded := []byte{0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	_, err = decoder.Decode(encoded)
+	assert.Equal(t, ErrIntegerValueTooLarge, err)
+	assert.Equal(t, maxInt, decoder.dynamicTableSizeMax)
+	assert.Equal(t, []Header{{Name: "a", Value: "b"}}, decoder.DynamicTableEntries())
+
+	// 2^63-1 itself is a valid size
+	_, err = decoder.Decode(encodeDynamicTableSizeUpdate(maxInt))
+	assert.Nil(t, err)
+	assert.Equal(t, maxInt, decoder.dynamicTableSizeMax)
+}
+
+func TestDecodeIntegerTruncated(t *testing.T) {
+	decoder := NewDecoder(256)
+	// all 5 prefix bits are set, so a continuation octet must follow
+	rest, _, decoded, err := decoder.DecodeInteger([]byte{0x1f}, 5)
+	assert.Equal(t, ErrIntegerTruncated, err)
+	assert.Nil(t, rest)
+	assert.Equal(t, 0, decoded)
+
+	// the continuation octet has its high bit set, so another one must follow
+	_, _, _, err = decoder.DecodeInteger([]byte{0x1f, 0x9a}, 5)
+	assert.Equal(t, ErrIntegerTruncated, err)
+
+	_, _, _, err = decoder.DecodeInteger([]byte{}, 5)
+	assert.Equal(t, ErrIntegerTruncated, err)
+}
+
+func TestDecodeIntegerOverflow(t *testing.T) {
+	decoder := NewDecoder(256)
+	decoder.SetMaxIntegerValue(maxInt)
+	decoder.SetMaxIntegerEncodedLength(16)
+
+	_, _, decoded, err := decoder.DecodeInteger(encodeInteger(maxInt, 5), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, maxInt, decoded)
+
+	encoded := []byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	_, _, _, err = decoder.DecodeInteger(encoded, 5)
+	assert.Equal(t, ErrIntegerValueTooLarge, err)
+}
+
+func TestIntegerEncodedLen(t *testing.T) {
+	assert.Equal(t, 1, IntegerEncodedLen(10, 5))
+	assert.Equal(t, 3, IntegerEncodedLen(1337, 5))
+	assert.Equal(t, 1, IntegerEncodedLen(42, 8))
+
+	for prefixLength := 1; prefixLength <= 8; prefixLength++ {
+		max := (1 << uint(prefixLength)) - 1
+		for _, number := range []int{0, max - 1, max, max + 127, max + 128, max + 16383, max + 16384, DefaultMaxIntegerValue} {
+			assert.Equal(t, len(encodeInteger(number, prefixLength)), IntegerEncodedLen(number, prefixLength), "%d with prefix %d", number, prefixLength)
+		}
+	}
+
+	assert.Equal(t, 0, IntegerEncodedLen(10, 0))
+	assert.Equal(t, 0, IntegerEncodedLen(10, 9))
+}
+
+func TestEncodeIntegerInvalidPrefixLength(t *testing.T) {
+	encoder := NewEncoder(256)
+	for _, prefixLength := range []int{0, 9} {
+		encoded, err := encoder.EncodeInteger(10, prefixLength)
+		assert.Equal(t, ErrInvalidPrefixLength, err)
+		assert.Nil(t, encoded)
+	}
+
+	encoded, err := encoder.EncodeInteger(1337, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{31, 154, 10}, encoded)
+}
+
+func TestEncodeIntegerNegative(t *testing.T) {
+	encoder := NewEncoder(256)
+	for _, number := range []int{-1, -128, -maxInt - 1} {
+		encoded, err := encoder.EncodeInteger(number, 5)
+		assert.Equal(t, ErrNegativeInteger, err)
+		assert.Nil(t, encoded)
+
+		encoded, err = encoder.EncodeIntegerWithPrefix(number, 5, 0x20)
+		assert.Equal(t, ErrNegativeInteger, err)
+		assert.Nil(t, encoded)
+
+		var buf bytes.Buffer
+		assert.Equal(t, ErrNegativeInteger, WriteInteger(&buf, number, 5, 0))
+		assert.Equal(t, 0, buf.Len())
+		assert.Equal(t, 0, IntegerEncodedLen(number, 5))
+	}
+
+	for prefixLength := 1; prefixLength <= 8; prefixLength++ {
+		encoded, err := encoder.EncodeInteger(0, prefixLength)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0x00}, encoded)
+		assert.Equal(t, 1, IntegerEncodedLen(0, prefixLength))
+	}
+}
+
+func TestHeaderString(t *testing.T) {
+	assert.Equal(t, "custom-key: custom-value", Header{Name: "custom-key", Value: "custom-value"}.String())
+	assert.Equal(t, "password: secret (sensitive)", Header{Name: "password", Value: "secret", Sensitive: true}.String())
+	assert.Equal(t, ":authority: ", Header{Name: ":authority"}.String())
+}
+
+func TestRepresentationString(t *testing.T) {
+	assert.Equal(t, "indexed", RepresentationIndexed.String())
+	assert.Equal(t, "literal with incremental indexing", RepresentationLiteralIncrementalIndexing.String())
+	assert.Equal(t, "literal without indexing", RepresentationLiteralNotIndexed.String())
+	assert.Equal(t, "literal never indexed", RepresentationLiteralNeverIndexed.String())
+	assert.Equal(t, "dynamic table size update", RepresentationDynamicTableSizeUpdate.String())
+	assert.Equal(t, "Representation(42)", Representation(42).String())
+}
+
+func TestWriteInteger(t *testing.T) {
+	for _, number := range []int{10, 1337, 42} {
+		var buf bytes.Buffer
+		if err := WriteInteger(&buf, number, 5, headerFieldDynamicSizeUpdate); err != nil {
+			t.Fatal(err)
+		}
+		expected := encodeInteger(number, 5)
+		expected[0] |= headerFieldDynamicSizeUpdate
+		assert.Equal(t, expected, buf.Bytes())
+	}
+
+	var buf bytes.Buffer
+	assert.Equal(t, ErrInvalidPrefixLength, WriteInteger(&buf, 10, 0, 0))
+	assert.Equal(t, ErrInvalidPrefixLength, WriteInteger(&buf, 10, 9, 0))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestWriteLiteralString(t *testing.T) {
+	for _, huffman := range []bool{false, true} {
+		for _, str := range []string{"", "custom-key", "www.example.com"} {
+			var buf bytes.Buffer
+			if err := WriteLiteralString(&buf, str, huffman); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, encodeLiteralString(str, 7, huffman), buf.Bytes())
+		}
+	}
+}
+
 func TestEncodeHeaderNeverIndexed(t *testing.T) {
 	items := [][3]string{
 		{"100870617373776f726406736563726574", "password", "secret"},
@@ -63,6 +255,27 @@ func TestEncodeHeaderNeverIndexed(t *testing.T) {
 	}
 }
 
+func TestEncodeHeaderNeverIndexedDynamicName(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+
+	encoded, err := encoder.EncodeTrusted([]Header{{Name: "custom-key", Value: "custom-value"}}, false)
+	assert.Nil(t, err)
+	_, err = decoder.Decode(encoded)
+	assert.Nil(t, err)
+
+	// the name is referenced with index 62, the value is a literal
+	encoded, err = encoder.EncodeTrusted([]Header{{Name: "custom-key", Value: "secret", Sensitive: true}}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1f, 0x2f, 0x06, 's', 'e', 'c', 'r', 'e', 't'}, encoded)
+	assert.Equal(t, 1, len(encoder.DynamicTableEntries()))
+
+	headers, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "secret", Sensitive: true}}, headers)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+}
+
 func TestParseHeaderNeverIndexed(t *testing.T) {
 	items := [][3]string{
 		{"100870617373776f726406736563726574", "password", "secret"},
@@ -86,6 +299,125 @@ func TestParseHeaderNeverIndexed(t *testing.T) {
 	}
 }
 
+func TestDecodeFields(t *testing.T) {
+	encoded, err := hex.DecodeString("82" +
+		"400a637573746f6d2d6b65790d637573746f6d2d686561646572" +
+		"040c2f73616d706c652f70617468" +
+		"100870617373776f726406736563726574")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	fields, err := decoder.DecodeFields(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []HeaderField{
+		{Header: Header{":method", "GET", false}, Representation: RepresentationIndexed},
+		{Header: Header{"custom-key", "custom-header", false}, Representation: RepresentationLiteralIncrementalIndexing},
+		{Header: Header{":path", "/sample/path", false}, Representation: RepresentationLiteralNotIndexed},
+		{Header: Header{"password", "secret", true}, Representation: RepresentationLiteralNeverIndexed},
+	}, fields)
+}
+
+func TestDecodeFieldsRoundTrip(t *testing.T) {
+	encoded, err := hex.DecodeString("82" +
+		"400a637573746f6d2d6b65790d637573746f6d2d686561646572" +
+		"040c2f73616d706c652f70617468" +
+		"100870617373776f726406736563726574")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	fields, err := decoder.DecodeFields(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder := NewEncoder(256)
+	var reencoded []byte
+	for _, field := range fields {
+		var enc []byte
+		if field.Representation == RepresentationLiteralNotIndexed {
+			enc, err = encoder.EncodeNoDynamicIndexing(field.Header, false)
+		} else {
+			enc, err = encoder.EncodeIndexed(field.Header, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		reencoded = append(reencoded, enc...)
+	}
+	assert.Equal(t, encoded, reencoded)
+	assert.Equal(t, decoder.DynamicTableEntries(), encoder.DynamicTableEntries())
+}
+
+func TestDecodeNeverIndexedNotAddedToDynamicTable(t *testing.T) {
+	decoder := NewDecoder(256)
+	decoder.addNewDynamicEntry("custom-key", "custom-value")
+
+	encoded, err := hex.DecodeString("100870617373776f726406736563726574")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{"password", "secret", true}}, headers)
+	assert.Equal(t, []Header{{"custom-key", "custom-value", false}}, decoder.DynamicTableEntries())
+	assert.Equal(t, 32+10+12, decoder.dynamicTableSizeCurrent)
+}
+
+func TestEncodeSensitiveNotAddedToDynamicTable(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.addNewDynamicEntry("custom-key", "custom-value")
+
+	for _, header := range []Header{{"password", "secret", true}, {"authorization", "secret", true}} {
+		_, err := encoder.EncodeIndexed(header, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, []Header{{"custom-key", "custom-value", false}}, encoder.DynamicTableEntries())
+	assert.Equal(t, 32+10+12, encoder.dynamicTableSizeCurrent)
+}
+
+func TestDecodeFieldsCaptureRawValues(t *testing.T) {
+	encoded, err := hex.DecodeString("82" + "418cf1e3c2e5f23a6ba0ab90f4ff" + "040c2f73616d706c652f70617468" + "be")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	decoder.SetCaptureRawValues(true)
+	fields, err := decoder.DecodeFields(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(fields))
+
+	assert.Nil(t, fields[0].RawValue)
+	assert.Equal(t, encoded[3:15], fields[1].RawValue)
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(fields[1].RawValue))
+	assert.True(t, fields[1].ValueHuffman)
+	assert.Equal(t, "www.example.com", fields[1].Value)
+	assert.Equal(t, []byte("/sample/path"), fields[2].RawValue)
+	assert.False(t, fields[2].ValueHuffman)
+	assert.Nil(t, fields[3].RawValue)
+	assert.Equal(t, "www.example.com", fields[3].Value)
+
+	decoder = NewDecoder(256)
+	fields, err = decoder.DecodeFields(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, fields[1].RawValue)
+	assert.False(t, fields[1].ValueHuffman)
+}
+
 func TestParseHeaders(t *testing.T) {
 	items := [][3]string{
 		{"400a637573746f6d2d6b65790d637573746f6d2d686561646572", "custom-key", "custom-header"},
@@ -134,7 +466,7 @@ func testHeaderEncoding(t *testing.T, encodedHexValues []string, headers [][]Hea
 		}
 		assert.Equal(t, encodedHexValues[x], hex.EncodeToString(encoded))
 		if dynamicTable != nil {
-			assert.Equal(t, dynamicTable[x], encoder.dynamicTable)
+			assert.Equal(t, dynamicTable[x], encoder.DynamicTableEntries())
 		}
 	}
 }
@@ -154,100 +486,520 @@ func testHeaderParsing(t *testing.T, encodedHexValues []string, expected [][]Hea
 		assert.Equal(t, len(expected[x]), len(headers))
 		assert.Equal(t, expected[x], headers)
 		if dynamicTable != nil {
-			assert.Equal(t, dynamicTable[x], decoder.dynamicTable)
+			assert.Equal(t, dynamicTable[x], decoder.DynamicTableEntries())
 		}
 	}
 }
 
-func TestEncodeWithNoIndexing(t *testing.T) {
+func TestDecodeReuse(t *testing.T) {
 	encodedHexValues := []string{
-		"040c2f73616d706c652f70617468",
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684be58086e6f2d6361636865",
+		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
 	}
-	headers := [][]Header{
-		{
-			{":path", "/sample/path", false},
-		},
+
+	decoder := NewDecoder(256)
+	reuseDecoder := NewDecoder(256)
+	buf := make([]Header, 0, 2)
+	for _, encodedHex := range encodedHexValues {
+		encoded, err := hex.DecodeString(encodedHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := decoder.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err = reuseDecoder.DecodeReuse(encoded, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, buf)
+		assert.Equal(t, decoder.DynamicTableEntries(), reuseDecoder.DynamicTableEntries())
 	}
+}
 
-	testHeaderEncoding(t, encodedHexValues, headers, nil, 256, false, false)
+func TestDecodeContext(t *testing.T) {
+	encoded, err := hex.DecodeString("828684410f7777772e6578616d706c652e636f6d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	headers, err := decoder.DecodeContext(context.Background(), encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(headers))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	decoder = NewDecoder(256)
+	headers, err = decoder.DecodeContext(ctx, encoded)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, headers)
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+
+	// cancel once the first field has been added to the dynamic table, the context is
+	// checked again after decodeContextCheckInterval fields
+	block := append([]byte{}, encoded[3:]...)
+	for x := 0; x < decodeContextCheckInterval; x++ {
+		block = append(block, 0x82)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	decoder = NewDecoder(256)
+	decoder.SetTracer(func(DecodeEvent) { cancel() })
+	headers, err = decoder.DecodeContext(ctx, block)
+	assert.Equal(t, ctx.Err(), err)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, headers)
+	// the entry stays in the dynamic table although the block failed to decode
+	assert.Equal(t, []Header{{Name: ":authority", Value: "www.example.com"}}, decoder.DynamicTableEntries())
 }
 
-func TestEncodeWithDynamicTableNoHuffman(t *testing.T) {
-	encodedHexValues := []string{
-		"828684410f7777772e6578616d706c652e636f6d",
-		"828684be58086e6f2d6361636865",
-		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+func TestDecodeEmptyBlock(t *testing.T) {
+	decoder := NewDecoder(256)
+	headers, err := decoder.Decode([]byte{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	headers := [][]Header{
-		{
-			{":method", "GET", false},
-			{":scheme", "http", false},
-			{":path", "/", false},
-			{":authority", "www.example.com", false},
-		},
-		{
-			{":method", "GET", false},
-			{":scheme", "http", false},
-			{":path", "/", false},
-			{":authority", "www.example.com", false},
-			{"cache-control", "no-cache", false},
-		},
-		{
-			{":method", "GET", false},
-			{":scheme", "https", false},
-			{":path", "/index.html", false},
-			{":authority", "www.example.com", false},
-			{"custom-key", "custom-value", false},
-		},
+	assert.Equal(t, []Header{}, headers)
+
+	decoder.SetRejectEmptyBlock(true)
+	headers, err = decoder.Decode([]byte{})
+	assert.Equal(t, ErrEmptyBlock, err)
+	assert.Nil(t, headers)
+	_, err = decoder.DecodeFields(nil)
+	assert.Equal(t, ErrEmptyBlock, err)
+
+	// a block with only a size update is not empty
+	headers, err = decoder.Decode([]byte{0x3f, 0x45})
+	if err != nil {
+		t.Fatal(err)
 	}
+	assert.Equal(t, []Header{}, headers)
+}
 
-	testHeaderEncoding(t, encodedHexValues, headers, nil, 256, false, true)
+func BenchmarkDecode(b *testing.B) {
+	encoded, _ := hex.DecodeString("828684040c2f73616d706c652f70617468")
+	decoder := NewDecoder(256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.Decode(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
 
-func TestDecodeWithDynamicTableNoHuffman(t *testing.T) {
-	encodedHexValues := []string{
-		"828684410f7777772e6578616d706c652e636f6d",
-		"828684be58086e6f2d6361636865",
-		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+func BenchmarkDecodeReuse(b *testing.B) {
+	encoded, _ := hex.DecodeString("828684040c2f73616d706c652f70617468")
+	decoder := NewDecoder(256)
+	buf := make([]Header, 0, 8)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = decoder.DecodeReuse(encoded, buf); err != nil {
+			b.Fatal(err)
+		}
 	}
-	expected := [][]Header{
-		{
-			{":method", "GET", false},
-			{":scheme", "http", false},
-			{":path", "/", false},
-			{":authority", "www.example.com", false},
-		},
-		{
-			{":method", "GET", false},
-			{":scheme", "http", false},
-			{":path", "/", false},
-			{":authority", "www.example.com", false},
-			{"cache-control", "no-cache", false},
-		},
-		{
-			{":method", "GET", false},
-			{":scheme", "https", false},
-			{":path", "/index.html", false},
-			{":authority", "www.example.com", false},
-			{"custom-key", "custom-value", false},
-		},
+}
+
+func TestIndexNotFoundErrors(t *testing.T) {
+	decoder := NewDecoder(256)
+	decoder.addNewDynamicEntry("a", "b")
+
+	_, err := decoder.Decode([]byte{0x80})
+	assert.EqualError(t, err, "index not found: index 0 is out of range of the static table (61 entries)")
+
+	_, err = decoder.Decode([]byte{0xbf})
+	assert.EqualError(t, err, "index not found: index 63 is past the end of the dynamic table (dynamic index 2, 1 entries)")
+
+	headers, err := decoder.Decode([]byte{0xbe})
+	if err != nil {
+		t.Fatal(err)
 	}
+	assert.Equal(t, []Header{{"a", "b", false}}, headers)
+}
 
-	testHeaderParsing(t, encodedHexValues, expected, nil, 256)
+func TestParseHeaderFieldNotIndexedInvalidNameIndex(t *testing.T) {
+	for _, representation := range []byte{headerFieldLiteralNotIndexed, headerFieldLiteralNeverIndexed} {
+		// index past the static table with an empty dynamic table
+		decoder := NewDecoder(256)
+		encoded := encodeInteger(70, 4)
+		encoded[0] |= representation
+		encoded = append(encoded, encodeLiteralString("value", 7, false)...)
+		rest, header, err := decoder.parseHeaderField(encoded)
+		assert.EqualError(t, err, "index not found: index 70 is past the end of the dynamic table (dynamic index 9, 0 entries)")
+		assert.Nil(t, rest)
+		assert.Nil(t, header)
+
+		// index of an entry that has been evicted
+		decoder = NewDecoder(32 + 2)
+		decoder.addNewDynamicEntry("a", "b")
+		decoder.addNewDynamicEntry("c", "d")
+		encoded = encodeInteger(63, 4)
+		encoded[0] |= representation
+		encoded = append(encoded, encodeLiteralString("value", 7, false)...)
+		rest, header, err = decoder.parseHeaderField(encoded)
+		assert.EqualError(t, err, "index not found: index 63 is past the end of the dynamic table (dynamic index 2, 1 entries)")
+		assert.Nil(t, rest)
+		assert.Nil(t, header)
+
+		_, err = decoder.Decode(encoded)
+		assert.Error(t, err)
+	}
 }
 
-func TestEncodeWithDynamicTableHuffman(t *testing.T) {
+func TestEncodeWithNoIndexing(t *testing.T) {
 	encodedHexValues := []string{
-		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
-		"828684be5886a8eb10649cbf",
-		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		"040c2f73616d706c652f70617468",
 	}
 	headers := [][]Header{
 		{
-			{":method", "GET", false},
-			{":scheme", "http", false},
-			{":path", "/", false},
-			{":authority", "www.example.com", false},
+			{":path", "/sample/path", false},
+		},
+	}
+
+	testHeaderEncoding(t, encodedHexValues, headers, nil, 256, false, false)
+}
+
+func TestEncodeWithHuffmanPolicy(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.SetHuffmanPolicy(func(header Header) bool {
+		return header.Name != "set-cookie"
+	})
+
+	encoded, err := encoder.Encode([]Header{
+		{"set-cookie", "id=1", false},
+		{"cache-control", "no-cache", false},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "770469643d31"+"5886a8eb10649cbf", hex.EncodeToString(encoded))
+
+	encoder.SetHuffmanPolicy(nil)
+	encoded, err = encoder.EncodeIndexed(Header{"set-cookie", "id=2", false}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "7783", hex.EncodeToString(encoded[:2]))
+}
+
+func TestEncodeWithValidation(t *testing.T) {
+	invalid := []struct {
+		header Header
+		err    error
+	}{
+		{Header{"Content-Type", "text/html", false}, ErrInvalidHeaderName},
+		{Header{"", "value", false}, ErrInvalidHeaderName},
+		{Header{":", "value", false}, ErrInvalidHeaderName},
+		{Header{"custom key", "value", false}, ErrInvalidHeaderName},
+		{Header{"custom-key", "value\r\nx-injected: 1", false}, ErrInvalidHeaderValue},
+		{Header{"custom-key", "val\x00ue", false}, ErrInvalidHeaderValue},
+	}
+
+	for _, item := range invalid {
+		encoder := NewEncoder(256)
+		encoder.SetValidateHeaders(true)
+		_, err := encoder.Encode([]Header{item.header})
+		assert.Equal(t, item.err, err, item.header.Name)
+		_, err = encoder.EncodeIndexed(item.header, false)
+		assert.Equal(t, item.err, err, item.header.Name)
+		_, err = encoder.EncodeNoDynamicIndexing(item.header, false)
+		assert.Equal(t, item.err, err, item.header.Name)
+		assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+
+		_, err = encoder.EncodeTrusted([]Header{item.header}, false)
+		assert.Nil(t, err)
+	}
+
+	encoder := NewEncoder(256)
+	encoder.SetValidateHeaders(true)
+	_, err := encoder.Encode([]Header{{":path", "/", false}, {"x-custom_key.1", "a b\tc", false}})
+	assert.Nil(t, err)
+}
+
+func TestEncodeWithValidationInvalidHeaderInList(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.SetValidateHeaders(true)
+	decoder := NewDecoder(256)
+	encoder.SetDynamicTableMaxSize(128)
+
+	_, err := encoder.Encode([]Header{
+		{"custom-key", "custom-value", false},
+		{"Invalid-Key", "value", false},
+		{"custom-key2", "custom-value2", false},
+	})
+	assert.Equal(t, ErrInvalidHeaderName, err)
+	assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+
+	// the pending size update and the table are sent with the next block
+	headers := []Header{{"custom-key", "custom-value", false}, {"custom-key", "custom-value", false}}
+	encoded, err := encoder.Encode(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, headers, decoded)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+}
+
+func TestEncodeWithNormalizedNames(t *testing.T) {
+	lowercase := []Header{
+		{"content-type", "Text/HTML", false},
+		{":method", "GET", false},
+		{"x-custom-key", "Value", false},
+	}
+	mixedCase := []Header{
+		{"Content-Type", "Text/HTML", false},
+		{":Method", "GET", false},
+		{"X-Custom-Key", "Value", false},
+	}
+
+	expected, err := NewEncoder(256).Encode(lowercase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without normalization the names are case-sensitive
+	encoded, err := NewEncoder(256).Encode(mixedCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, expected, encoded)
+
+	encoder := NewEncoder(256)
+	encoder.SetNormalizeNames(true)
+	encoder.SetValidateHeaders(true)
+	assert.Equal(t, RepresentationIndexed, encoder.WouldIndex(Header{":Method", "GET", false}))
+	encoded, err = encoder.Encode(mixedCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, encoded)
+
+	decoder := NewDecoder(256)
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lowercase, headers)
+
+	encoded, err = encoder.EncodeIndexed(Header{"Content-Type", "Text/HTML", false}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0xbf}, encoded)
+}
+
+func benchmarkEncodeHeaders() []Header {
+	return []Header{
+		{":method", "GET", false},
+		{":scheme", "https", false},
+		{":path", "/index.html", false},
+		{":authority", "www.example.com", false},
+		{"user-agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)", false},
+		{"custom-key", "custom-value", false},
+	}
+}
+
+func BenchmarkEncodeValidated(b *testing.B) {
+	headers := benchmarkEncodeHeaders()
+	encoder := NewEncoder(4096)
+	encoder.SetValidateHeaders(true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encoder.Encode(headers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeTrusted(b *testing.B) {
+	headers := benchmarkEncodeHeaders()
+	encoder := NewEncoder(4096)
+	encoder.SetValidateHeaders(true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encoder.EncodeTrusted(headers, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeDuplicateHeaderIndexed(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoded, err := encoder.EncodeTrusted([]Header{
+		{"custom-key", "custom-value", false},
+		{"custom-key", "custom-value", false},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "400a637573746f6d2d6b65790c637573746f6d2d76616c7565"+"be", hex.EncodeToString(encoded))
+	assert.Equal(t, []Header{{"custom-key", "custom-value", false}}, encoder.DynamicTableEntries())
+}
+
+func TestEncodeTo(t *testing.T) {
+	encoder := NewEncoder(256)
+	expectedEncoder := NewEncoder(256)
+	buf := []byte("previous block")
+	for i, headers := range benchmarkC5Headers {
+		expected, err := expectedEncoder.Encode(headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// dst is truncated, so the octets already in it are overwritten
+		encoded, err := encoder.EncodeTo(buf, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, encoded, "C.5.%d", i+1)
+		if len(expected) <= cap(buf) {
+			assert.Equal(t, &buf[:1][0], &encoded[0], "C.5.%d reuses dst", i+1)
+		}
+		buf = encoded
+	}
+	assert.Equal(t, expectedEncoder.DynamicTableEntries(), encoder.DynamicTableEntries())
+	assert.Equal(t, expectedEncoder.Stats(), encoder.Stats())
+}
+
+func TestEncodeWithNoIndexingLargeNameIndex(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoded, err := encoder.EncodeNoDynamicIndexing(Header{"www-authenticate", "Basic", false}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "0f2e054261736963", hex.EncodeToString(encoded))
+
+	decoder := NewDecoder(256)
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{"www-authenticate", "Basic", false}}, headers)
+}
+
+func TestWouldIndex(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.addNewDynamicEntry("custom-key", "custom-value")
+
+	assert.Equal(t, RepresentationIndexed, encoder.WouldIndex(Header{":method", "GET", false}))
+	assert.Equal(t, RepresentationIndexed, encoder.WouldIndex(Header{"custom-key", "custom-value", false}))
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{":method", "PUT", false}))
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{"custom-key", "other-value", false}))
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{"x-unknown", "value", false}))
+	assert.Equal(t, RepresentationLiteralNeverIndexed, encoder.WouldIndex(Header{"custom-key", "custom-value", true}))
+
+	assert.Equal(t, []Header{{"custom-key", "custom-value", false}}, encoder.DynamicTableEntries())
+	assert.Equal(t, 32+10+12, encoder.dynamicTableSizeCurrent)
+}
+
+func TestEncodeWithDynamicTableNoHuffman(t *testing.T) {
+	encodedHexValues := []string{
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684be58086e6f2d6361636865",
+		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+	}
+	headers := [][]Header{
+		{
+			{":method", "GET", false},
+			{":scheme", "http", false},
+			{":path", "/", false},
+			{":authority", "www.example.com", false},
+		},
+		{
+			{":method", "GET", false},
+			{":scheme", "http", false},
+			{":path", "/", false},
+			{":authority", "www.example.com", false},
+			{"cache-control", "no-cache", false},
+		},
+		{
+			{":method", "GET", false},
+			{":scheme", "https", false},
+			{":path", "/index.html", false},
+			{":authority", "www.example.com", false},
+			{"custom-key", "custom-value", false},
+		},
+	}
+
+	testHeaderEncoding(t, encodedHexValues, headers, nil, 256, false, true)
+}
+
+func TestDecodeWithDynamicTableNoHuffman(t *testing.T) {
+	encodedHexValues := []string{
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684be58086e6f2d6361636865",
+		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+	}
+	expected := [][]Header{
+		{
+			{":method", "GET", false},
+			{":scheme", "http", false},
+			{":path", "/", false},
+			{":authority", "www.example.com", false},
+		},
+		{
+			{":method", "GET", false},
+			{":scheme", "http", false},
+			{":path", "/", false},
+			{":authority", "www.example.com", false},
+			{"cache-control", "no-cache", false},
+		},
+		{
+			{":method", "GET", false},
+			{":scheme", "https", false},
+			{":path", "/index.html", false},
+			{":authority", "www.example.com", false},
+			{"custom-key", "custom-value", false},
+		},
+	}
+
+	testHeaderParsing(t, encodedHexValues, expected, nil, 256)
+}
+
+func TestDecodeHuffmanNotAllowed(t *testing.T) {
+	encoded, err := hex.DecodeString("418cf1e3c2e5f23a6ba0ab90f4ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(256)
+	decoder.SetAllowHuffman(false)
+	_, err = decoder.Decode(encoded)
+	assert.Equal(t, ErrHuffmanNotAllowed, err)
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+
+	encoded, err = hex.DecodeString("410f7777772e6578616d706c652e636f6d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{":authority", "www.example.com", false}}, headers)
+}
+
+func TestEncodeWithDynamicTableHuffman(t *testing.T) {
+	encodedHexValues := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	headers := [][]Header{
+		{
+			{":method", "GET", false},
+			{":scheme", "http", false},
+			{":path", "/", false},
+			{":authority", "www.example.com", false},
 		},
 		{
 			{":method", "GET", false},
@@ -402,6 +1154,149 @@ func TestDecodeWithDynamicTableEvictionsHuffman(t *testing.T) {
 	testHeaderParsing(t, encodedHexValues, expected, dynamicTable, 256)
 }
 
+// https://tools.ietf.org/html/rfc7541#appendix-C.6
+func TestExampleC6ResponsesHuffman(t *testing.T) {
+	setCookie := "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"
+	steps := []struct {
+		block   string
+		headers []Header
+		table   []Header
+		size    int
+	}{
+		{
+			"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+			[]Header{
+				{Name: ":status", Value: "302"},
+				{Name: "cache-control", Value: "private"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+				{Name: "location", Value: "https://www.example.com"},
+			},
+			[]Header{
+				{Name: "location", Value: "https://www.example.com"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+				{Name: "cache-control", Value: "private"},
+				{Name: ":status", Value: "302"},
+			},
+			222,
+		},
+		{
+			// :status 307 evicts :status 302
+			"4883640effc1c0bf",
+			[]Header{
+				{Name: ":status", Value: "307"},
+				{Name: "cache-control", Value: "private"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+				{Name: "location", Value: "https://www.example.com"},
+			},
+			[]Header{
+				{Name: ":status", Value: "307"},
+				{Name: "location", Value: "https://www.example.com"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+				{Name: "cache-control", Value: "private"},
+			},
+			222,
+		},
+		{
+			// the new date evicts cache-control, content-encoding evicts the old date and
+			// set-cookie evicts both location and :status 307
+			"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007",
+			[]Header{
+				{Name: ":status", Value: "200"},
+				{Name: "cache-control", Value: "private"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+				{Name: "location", Value: "https://www.example.com"},
+				{Name: "content-encoding", Value: "gzip"},
+				{Name: "set-cookie", Value: setCookie},
+			},
+			[]Header{
+				{Name: "set-cookie", Value: setCookie},
+				{Name: "content-encoding", Value: "gzip"},
+				{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+			},
+			215,
+		},
+	}
+
+	encoder := NewEncoder(256)
+	decoder := NewDecoder(256)
+	for i, step := range steps {
+		encoded, err := encoder.Encode(step.headers)
+		assert.Nil(t, err)
+		assert.Equal(t, step.block, hex.EncodeToString(encoded), "C.6.%d", i+1)
+		assert.Equal(t, step.table, encoder.DynamicTableEntries(), "C.6.%d", i+1)
+		assert.Equal(t, step.size, encoder.dynamicTableSizeCurrent, "C.6.%d", i+1)
+
+		block, _ := hex.DecodeString(step.block)
+		headers, err := decoder.Decode(block)
+		assert.Nil(t, err)
+		assert.Equal(t, step.headers, headers, "C.6.%d", i+1)
+		assert.Equal(t, step.table, decoder.DynamicTableEntries(), "C.6.%d", i+1)
+		assert.Equal(t, step.size, decoder.dynamicTableSizeCurrent, "C.6.%d", i+1)
+	}
+
+	// the set-cookie value is the last string literal of C.6.3
+	encodedValue := HuffmanEncode([]byte(setCookie))
+	assert.Equal(t, steps[2].block[len(steps[2].block)-2*len(encodedValue):], hex.EncodeToString(encodedValue))
+	decodedValue, err := HuffmanDecode(encodedValue)
+	assert.Nil(t, err)
+	assert.Equal(t, setCookie, string(decodedValue))
+}
+
+func TestEncoderStats(t *testing.T) {
+	encodedHexValues := []string{
+		"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+		"4803333037c1c0bf",
+		"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b2076657273696f6e3d31",
+	}
+	headers := [][]Header{
+		{
+			{":status", "302", false},
+			{"cache-control", "private", false},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT", false},
+			{"location", "https://www.example.com", false},
+		},
+		{
+			{":status", "307", false},
+			{"cache-control", "private", false},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT", false},
+			{"location", "https://www.example.com", false},
+		},
+		{
+			{":status", "200", false},
+			{"cache-control", "private", false},
+			{"date", "Mon, 21 Oct 2013 20:13:22 GMT", false},
+			{"location", "https://www.example.com", false},
+			{"content-encoding", "gzip", false},
+			{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1", false},
+		},
+	}
+
+	encoder := NewEncoder(256)
+	uncompressedBytes := 0
+	encodedBytes := 0
+	for x, block := range headers {
+		encoded, err := encoder.EncodeTrusted(block, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, encodedHexValues[x], hex.EncodeToString(encoded))
+		for _, header := range block {
+			uncompressedBytes += len(header.Name) + len(header.Value)
+		}
+		encodedBytes += len(encoded)
+	}
+
+	stats := encoder.Stats()
+	assert.Equal(t, uncompressedBytes, stats.UncompressedBytes)
+	assert.Equal(t, encodedBytes, stats.EncodedBytes)
+	assert.Equal(t, 6, stats.IndexedFields)
+	assert.Equal(t, 8, stats.LiteralFields)
+	assert.True(t, stats.EncodedBytes < stats.UncompressedBytes)
+
+	encoder.ResetStats()
+	assert.Equal(t, EncoderStats{}, encoder.Stats())
+}
+
 func TestDecodeWithDynamicTableEvictionsNoHuffman(t *testing.T) {
 	encodedHexValues := []string{
 		"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
@@ -453,41 +1348,2084 @@ func TestDecodeWithDynamicTableEvictionsNoHuffman(t *testing.T) {
 	testHeaderParsing(t, encodedHexValues, expected, dynamicTable, 256)
 }
 
-func TestDynamicTableResizingEncoding(t *testing.T) {
-	encoder := NewEncoder(64 + 4)
-	encoder.addNewDynamicEntry("a", "b")
-	encoder.addNewDynamicEntry("b", "c")
-	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, encoder.dynamicTable)
-	encoder.SetDynamicTableMaxSize(63)
-	encoded, err := encoder.Encode([]Header{{"b", "c", false}})
+func TestCustomStaticTable(t *testing.T) {
+	entries := [][2]string{
+		{"x-request-id", ""},
+		{"content-type", "application/json"},
+		{"content-type", "text/plain"},
+	}
+
+	encoder := NewEncoderWithStaticTable(entries, 256)
+	encoded, err := encoder.EncodeTrusted([]Header{
+		{"content-type", "text/plain", false},
+		{"x-request-id", "1", false},
+		{"x-request-id", "1", false},
+		{"content-type", "text/html", false},
+	}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	assert.Equal(t, []byte{0x3f, 0x20}, encoded[:2])
-	_, _, decoded, err := decodeInteger(encoded, 5, DefaultMaxIntegerValue, DefaultMaxIntegerEncodedLength)
+	assert.Equal(t, "83"+"410131"+"84"+"4209746578742f68746d6c", hex.EncodeToString(encoded))
+
+	decoder := NewDecoderWithStaticTable(entries, 256)
+	headers, err := decoder.Decode(encoded)
 	if err != nil {
 		t.Fatal(err)
 	}
-	assert.Equal(t, 63, decoded)
+	assert.Equal(t, []Header{
+		{"content-type", "text/plain", false},
+		{"x-request-id", "1", false},
+		{"x-request-id", "1", false},
+		{"content-type", "text/html", false},
+	}, headers)
+	assert.Equal(t, encoder.DynamicTableEntries(), decoder.DynamicTableEntries())
+
+	_, err = decoder.Decode([]byte{0x86})
+	assert.EqualError(t, err, "index not found: index 6 is past the end of the dynamic table (dynamic index 3, 2 entries)")
+}
+
+func TestQPACKStaticTable(t *testing.T) {
+	assert.Equal(t, 99, len(qpackStaticTable))
+
+	headers := []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "application/json"},
+		{Name: "accept-encoding", Value: "gzip, deflate, br"},
+		{Name: "user-agent", Value: "x"},
+		{Name: "user-agent", Value: "x"},
+	}
+	encoder := NewQPACKStaticEncoder(256)
+	encoded, err := encoder.EncodeTrusted(headers, false)
+	assert.Nil(t, err)
+	// QPACK indices 17, 25, 46, 31, the name of 95 and the first dynamic entry
+	assert.Equal(t, "92"+"9a"+"af"+"a0"+"7f21"+"0178"+"e4", hex.EncodeToString(encoded))
+
+	decoder := NewQPACKStaticDecoder(256)
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+
+	// the HPACK indices don't match
+	_, err = NewDecoder(256).Decode(encoded)
+	assert.NotNil(t, err)
+}
+
+func TestStaticTableIndex(t *testing.T) {
+	index, ok := StaticTableNameValueIndex(":method", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+
+	index, ok = StaticTableNameIndex(":method")
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+
+	// user-agent is only in the static table with an empty value
+	index, ok = StaticTableNameIndex("user-agent")
+	assert.True(t, ok)
+	assert.Equal(t, 58, index)
+	_, ok = StaticTableNameValueIndex("user-agent", "")
+	assert.False(t, ok)
+	_, ok = StaticTableNameValueIndex(":method", "PUT")
+	assert.False(t, ok)
+
+	_, ok = StaticTableNameIndex("custom-key")
+	assert.False(t, ok)
+}
+
+func TestStaticTableEncoding(t *testing.T) {
+	names, namesWithValues := newStaticTableEncoding(staticTable)
+	assert.Equal(t, staticTableEncoding, names)
+	assert.Equal(t, staticTableEncodingWithValues, namesWithValues)
+}
+
+func randomHeaders(r *rand.Rand) []Header {
+	names := []string{":method", ":path", "cache-control", "cookie", "custom-key", "x-request-id", "authorization"}
+	headers := make([]Header, r.Intn(12))
+	for x := range headers {
+		var name string
+		if r.Intn(4) == 0 {
+			nameBytes := make([]byte, 1+r.Intn(20))
+			for y := range nameBytes {
+				nameBytes[y] = byte('a' + r.Intn(26))
+			}
+			name = string(nameBytes)
+		} else {
+			name = names[r.Intn(len(names))]
+		}
+
+		value := make([]byte, r.Intn(4)*r.Intn(100))
+		r.Read(value)
+		if r.Intn(3) == 0 {
+			value = value[:0]
+			value = append(value, byte('0'+r.Intn(4)))
+		}
+		headers[x] = Header{Name: name, Value: string(value), Sensitive: r.Intn(8) == 0}
+	}
+	return headers
+}
+
+func TestRoundTripRandomHeaders(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+
+	for x := 0; x < 500; x++ {
+		headers := randomHeaders(r)
+		huffman := r.Intn(2) == 0
+		encoded, err := encoder.EncodeTrusted(headers, huffman)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decoder.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, headers, decoded)
+		assert.Equal(t, encoder.DynamicTableEntries(), decoder.DynamicTableEntries())
+		assert.Equal(t, encoder.dynamicTableSizeCurrent, decoder.dynamicTableSizeCurrent)
+
+		if x%50 == 49 {
+			size := r.Intn(4096)
+			encoder.SetDynamicTableMaxSize(size)
+		}
+	}
+}
+
+func TestDynamicTableResizingEncoding(t *testing.T) {
+	encoder := NewEncoder(64 + 4)
+	encoder.addNewDynamicEntry("a", "b")
+	encoder.addNewDynamicEntry("b", "c")
+	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, encoder.DynamicTableEntries())
+	encoder.SetDynamicTableMaxSize(63)
+	encoded, err := encoder.Encode([]Header{{"b", "c", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0x3f, 0x20}, encoded[:2])
+	_, _, decoded, err := decodeInteger(encoded, 5, DefaultMaxIntegerValue, DefaultMaxIntegerEncodedLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 63, decoded)
 	assert.Equal(t, byte(0xbe), encoded[2])
-	assert.Equal(t, []Header{{"b", "c", false}}, encoder.dynamicTable)
+	assert.Equal(t, []Header{{"b", "c", false}}, encoder.DynamicTableEntries())
+}
+
+func TestFindHeaderInTablePrefersMostRecent(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.addNewDynamicEntry("x", "1")
+	encoder.addNewDynamicEntry("y", "2")
+	encoder.addNewDynamicEntry("x", "1")
+
+	index, valueIndexed := encoder.findHeaderInTable("x", "1")
+	assert.Equal(t, 62, index)
+	assert.True(t, valueIndexed)
+
+	index, valueIndexed = encoder.findHeaderInTable("y", "2")
+	assert.Equal(t, 63, index)
+	assert.True(t, valueIndexed)
+}
+
+func TestSeedDynamicTable(t *testing.T) {
+	entries := []Header{
+		{"custom-key", "custom-value", false},
+		{":authority", "www.example.com", false},
+		{"cache-control", "no-cache", false},
+	}
+
+	encoder := NewEncoder(256)
+	encoder.SeedDynamicTable(entries)
+	assert.Equal(t, []Header{entries[2], entries[1], entries[0]}, encoder.DynamicTableEntries())
+	assert.Equal(t, 32+10+12+32+10+15+32+13+8, encoder.dynamicTableSizeCurrent)
+
+	encoded, err := encoder.Encode([]Header{{":method", "GET", false}, entries[0], entries[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0x82, 0xc0, 0xbe}, encoded)
+
+	// the same entries seen by a decoder produce a matching table
+	decoder := NewDecoder(256)
+	for _, entry := range entries {
+		decoder.addNewDynamicEntry(entry.Name, entry.Value)
+	}
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{":method", "GET", false}, entries[0], entries[2]}, headers)
+
+	// seeding respects the maximum size
+	encoder = NewEncoder(100)
+	encoder.SeedDynamicTable(entries)
+	assert.Equal(t, []Header{entries[2]}, encoder.DynamicTableEntries())
+}
+
+func TestDynamicTableResizingEncodingToZero(t *testing.T) {
+	encoder := NewEncoder(256)
+	_, err := encoder.Encode([]Header{{"custom-key", "custom-value", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(encoder.DynamicTableEntries()))
+
+	encoder.SetDynamicTableMaxSize(0)
+	assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+	assert.Equal(t, 0, encoder.dynamicTableSizeCurrent)
+	assert.True(t, encoder.pendingDynamicTableSizeUpdate)
+
+	encoded, err := encoder.Encode([]Header{{":method", "GET", false}, {"custom-key", "custom-value", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x20), encoded[0])
+	assert.Equal(t, byte(0x82), encoded[1])
+	assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+
+	decoder := NewDecoder(256)
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{":method", "GET", false}, {"custom-key", "custom-value", false}}, headers)
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+}
+
+func TestDynamicTableResizingEncodingMinimumSize(t *testing.T) {
+	encoder := NewEncoder(256)
+	encoder.addNewDynamicEntry("custom-key", "custom-value")
+	encoder.addNewDynamicEntry("custom-key-2", "custom-value-2")
+	encoder.SetDynamicTableMaxSize(100)
+	encoder.SetDynamicTableMaxSize(200)
+
+	encoded, err := encoder.Encode([]Header{{":method", "GET", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "3f45"+"3fa901"+"82", hex.EncodeToString(encoded))
+
+	decoder := NewDecoder(256)
+	decoder.addNewDynamicEntry("custom-key", "custom-value")
+	decoder.addNewDynamicEntry("custom-key-2", "custom-value-2")
+	_, err = decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 200, decoder.dynamicTableSizeMax)
+	assert.Equal(t, encoder.DynamicTableEntries(), decoder.DynamicTableEntries())
+
+	// the minimum is reset once the update has been sent
+	encoded, err = encoder.Encode([]Header{{":method", "GET", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "82", hex.EncodeToString(encoded))
+
+	// only the final size is sent when it is the smallest
+	encoder.SetDynamicTableMaxSize(150)
+	encoder.SetDynamicTableMaxSize(100)
+	encoded, err = encoder.Encode([]Header{{":method", "GET", false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "3f45"+"82", hex.EncodeToString(encoded))
 }
 
 func TestDynamicTableResizing(t *testing.T) {
 	decoder := NewDecoder(64 + 4)
 	decoder.addNewDynamicEntry("a", "b")
 	decoder.addNewDynamicEntry("b", "c")
-	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, decoder.dynamicTable)
+	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, decoder.DynamicTableEntries())
 	_, err := decoder.Decode([]byte{63, 3})
 	if err != nil {
 		t.Fatal(err)
 	}
-	assert.Equal(t, []Header{{"b", "c", false}}, decoder.dynamicTable)
+	assert.Equal(t, []Header{{"b", "c", false}}, decoder.DynamicTableEntries())
+}
+
+func TestDynamicTableSizeUpdateDispatch(t *testing.T) {
+	assert.Equal(t, RepresentationDynamicTableSizeUpdate, representationOf(0x3f))
+	assert.Equal(t, RepresentationDynamicTableSizeUpdate, representationOf(0x20))
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, representationOf(0x7f))
+	assert.Equal(t, RepresentationLiteralNeverIndexed, representationOf(0x1f))
+
+	decoder := NewDecoder(256)
+	decoder.addNewDynamicEntry("custom-key", "custom-value")
+	decoder.addNewDynamicEntry("custom-key-2", "custom-value-2")
+	rest, header, err := decoder.parseHeaderField([]byte{0x3f, 0x45, 0x82})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, header)
+	assert.Equal(t, []byte{0x82}, rest)
+	assert.Equal(t, 100, decoder.dynamicTableSizeMax)
+	assert.Equal(t, []Header{{"custom-key-2", "custom-value-2", false}}, decoder.DynamicTableEntries())
+}
+
+func TestDynamicTableResizingTooLarge(t *testing.T) {
+	decoder := NewDecoder(64 + 4)
+	decoder.addNewDynamicEntry("a", "b")
+	decoder.addNewDynamicEntry("b", "c")
+
+	rest, header, err := decoder.parseHeaderField(append(encodeInteger(69, 5), 0x82))
+	assert.Error(t, err)
+	assert.Nil(t, rest)
+	assert.Nil(t, header)
+	assert.Equal(t, 64+4, decoder.dynamicTableSizeMax)
+	assert.Equal(t, 64+4, decoder.dynamicTableSizeCurrent)
+	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, decoder.DynamicTableEntries())
+}
+
+func TestParseHeaderFieldErrorReturnsNilBuffer(t *testing.T) {
+	items := []string{
+		"0011", // literal without indexing, name too long
+		"1011", // literal never indexed, name too long
+		"4011", // literal with incremental indexing, name too long
+	}
+	// an indexed field with an index not in the tables returns the rest of the
+	// buffer, see TestDecodeFieldIndexNotFoundRest
+
+	for _, item := range items {
+		encoded, err := hex.DecodeString(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder := NewDecoder(256)
+		decoder.SetMaxStringLiteralLength(16)
+		rest, header, err := decoder.parseHeaderField(encoded)
+		assert.Error(t, err, item)
+		assert.Nil(t, rest, item)
+		assert.Nil(t, header, item)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	var encoderEvicted, decoderEvicted []Header
+
+	encoder := NewEncoder(256)
+	encoder.SetOnEvict(func(evicted Header) {
+		encoderEvicted = append(encoderEvicted, evicted)
+	})
+	decoder := NewDecoder(256)
+	decoder.SetOnEvict(func(evicted Header) {
+		decoderEvicted = append(decoderEvicted, evicted)
+	})
+
+	headers := []Header{
+		{"custom-key-1", "custom-value-1", false},
+		{"custom-key-2", "custom-value-2", false},
+		{"custom-key-3", "custom-value-3", false},
+		{"custom-key-4", "custom-value-4", false},
+		{"custom-key-5", "custom-value-5", false},
+		{"custom-key-6", "custom-value-6", false},
+	}
+	encoded, err := encoder.Encode(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each entry is 58 octets, so only 4 fit in the table
+	assert.Equal(t, headers[:2], encoderEvicted)
+	assert.Equal(t, headers[:2], decoderEvicted)
+
+	encoder.SetDynamicTableMaxSize(58)
+	decoder.SetDynamicTableMaxSize(58)
+	assert.Equal(t, headers[:5], encoderEvicted)
+	assert.Equal(t, headers[:5], decoderEvicted)
+}
+
+func TestCheckDynamicTableSize(t *testing.T) {
+	decoder := NewDecoder(256)
+	decoder.addNewDynamicEntry("a", "b")
+	decoder.addNewDynamicEntry("b", "c")
+	assert.Nil(t, decoder.CheckDynamicTableSize())
+
+	decoder.dynamicTableSizeCurrent = 1000
+	assert.EqualError(t, decoder.CheckDynamicTableSize(), "dynamic table size doesn't match its entries: size is 1000 but the 2 entries have a size of 68")
+	assert.Equal(t, 1000, decoder.dynamicTableSizeCurrent)
+
+	encoder := NewEncoder(256)
+	encoder.addNewDynamicEntry("a", "b")
+	encoder.addNewDynamicEntry("b", "c")
+	assert.Nil(t, encoder.CheckDynamicTableSize())
+
+	encoder.dynamicTableSizeCurrent = -20
+	assert.ErrorIs(t, encoder.CheckDynamicTableSize(), ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, -20, encoder.dynamicTableSizeCurrent)
+
+	// resizing reports the drift instead of correcting it
+	decoder.dynamicTableSizeCurrent = 1000
+	assert.ErrorIs(t, decoder.SetDynamicTableMaxSize(100), ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, []Header{{"b", "c", false}, {"a", "b", false}}, decoder.DynamicTableEntries())
+	assert.Equal(t, 1000, decoder.dynamicTableSizeCurrent)
+}
+
+func TestDecodeWithZeroSizeDynamicTable(t *testing.T) {
+	decoder := NewDecoder(0)
+	encoded, err := hex.DecodeString("400a637573746f6d2d6b65790d637573746f6d2d686561646572" + "410f7777772e6578616d706c652e636f6d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Header{{"custom-key", "custom-header", false}, {":authority", "www.example.com", false}}, headers)
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 0, decoder.dynamicTableSizeCurrent)
+
+	_, err = decoder.Decode([]byte{0xbe})
+	assert.Error(t, err)
+}
+
+func TestDynamicTableSizeNeverNegative(t *testing.T) {
+	encoder := NewEncoder(256)
+	decoder := NewDecoder(256)
+	for x := 0; x < 10; x++ {
+		encoded, err := encoder.Encode([]Header{
+			{"custom-key", "custom-value", false},
+			{"cache-control", "no-cache", false},
+			{"x-counter", string(rune('a' + x)), false},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = decoder.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []int{100, 0, 60, 256} {
+			assert.Nil(t, encoder.SetDynamicTableMaxSize(size))
+			assert.Nil(t, decoder.SetDynamicTableMaxSize(size))
+			assert.True(t, encoder.dynamicTableSizeCurrent >= 0)
+			assert.True(t, decoder.dynamicTableSizeCurrent >= 0)
+			assert.Nil(t, encoder.CheckDynamicTableSize())
+			assert.Nil(t, decoder.CheckDynamicTableSize())
+		}
+	}
+
+	// an undercounted size is reported before anything is evicted instead of going negative
+	decoder = NewDecoder(256)
+	decoder.addNewDynamicEntry("a", "b")
+	decoder.addNewDynamicEntry("b", "c")
+	decoder.dynamicTableSizeCurrent = 10
+	assert.ErrorIs(t, decoder.SetDynamicTableMaxSize(40), ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, 2, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 256, decoder.dynamicTableSizeMax)
+
+	decoder.dynamicTableSizeCurrent = -100
+	fits, err := decoder.evictEntries(0, 256)
+	assert.False(t, fits)
+	assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, 2, len(decoder.DynamicTableEntries()))
+
+	encoder = NewEncoder(256)
+	encoder.addNewDynamicEntry("a", "b")
+	encoder.dynamicTableSizeCurrent = 1
+	fits, err = encoder.evictEntries(34, 34)
+	assert.False(t, fits)
+	assert.EqualError(t, err, "dynamic table size doesn't match its entries: size is 1 but the 1 entries have a size of 34")
+	assert.Equal(t, 1, len(encoder.DynamicTableEntries()))
+}
+
+func TestDynamicTableSizeInconsistent(t *testing.T) {
+	// a literal with incremental indexing that evicts the entry of an 80 octet table
+	block, err := hex.DecodeString("400a637573746f6d2d6b65790d637573746f6d2d686561646572")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{-100, 30, 1000} {
+		decoder := NewDecoder(80)
+		decoder.addNewDynamicEntry("a", "b")
+		decoder.dynamicTableSizeCurrent = size
+		headers, err := decoder.Decode(block)
+		assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent, "size %d", size)
+		assert.Nil(t, headers)
+
+		encoder := NewEncoder(80)
+		encoder.addNewDynamicEntry("a", "b")
+		encoder.dynamicTableSizeCurrent = size
+		encoded, err := encoder.Encode([]Header{{"custom-key", "custom-header", false}})
+		assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent, "size %d", size)
+		assert.Nil(t, encoded)
+	}
+
+	// nothing is changed before the error is returned, not even the callbacks are called
+	decoder := NewDecoder(80)
+	decoder.addNewDynamicEntry("a", "b")
+	decoder.dynamicTableSizeCurrent = 30
+	decoder.SetOnEvict(func(Header) { t.Error("entry evicted") })
+	decoder.SetTracer(func(DecodeEvent) { t.Error("event traced") })
+	_, err = decoder.Decode(block)
+	assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent)
+	_, err = decoder.Decode([]byte{0x20})
+	assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent)
+	assert.ErrorIs(t, decoder.SetDynamicTableMaxSize(0), ErrDynamicTableSizeInconsistent)
+	assert.ErrorIs(t, decoder.SetEntrySizeFunc(nil), ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, []Header{{"a", "b", false}}, decoder.DynamicTableEntries())
+	assert.Equal(t, 80, decoder.dynamicTableSizeMax)
+
+	encoder := NewEncoder(80)
+	encoder.addNewDynamicEntry("a", "b")
+	assert.Nil(t, encoder.SetDynamicTableMaxSize(80))
+	encoder.dynamicTableSizeCurrent = 30
+	encoder.SetOnEvict(func(Header) { t.Error("entry evicted") })
+	_, err = encoder.EncodeIndexed(Header{"custom-key", "custom-header", false}, false)
+	assert.ErrorIs(t, err, ErrDynamicTableSizeInconsistent)
+	assert.ErrorIs(t, encoder.SetDynamicTableMaxSize(0), ErrDynamicTableSizeInconsistent)
+	assert.ErrorIs(t, encoder.SetEntrySizeFunc(nil), ErrDynamicTableSizeInconsistent)
+	assert.ErrorIs(t, encoder.SeedDynamicTable([]Header{{"c", "d", false}}), ErrDynamicTableSizeInconsistent)
+	assert.Equal(t, []Header{{"a", "b", false}}, encoder.DynamicTableEntries())
+	assert.True(t, encoder.pendingDynamicTableSizeUpdate)
+	assert.Equal(t, EncoderStats{}, encoder.Stats())
+}
+
+func TestDynamicEntryOverhead(t *testing.T) {
+	assert.Equal(t, dynamicEntryOverhead+2, dynamicEntrySize("a", "b"))
+
+	decoder := NewDecoder(2 * (dynamicEntryOverhead + 2))
+	encoder := NewEncoder(2 * (dynamicEntryOverhead + 2))
+	for _, entry := range []Header{{"a", "b", false}, {"b", "c", false}} {
+		decoder.addNewDynamicEntry(entry.Name, entry.Value)
+		encoder.addNewDynamicEntry(entry.Name, entry.Value)
+	}
+	assert.Equal(t, 2, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 2, len(encoder.DynamicTableEntries()))
+	assert.Equal(t, 2*(dynamicEntryOverhead+2), decoder.dynamicTableSizeCurrent)
+	assert.Equal(t, 2*(dynamicEntryOverhead+2), encoder.dynamicTableSizeCurrent)
+
+	decoder.addNewDynamicEntry("c", "d")
+	encoder.addNewDynamicEntry("c", "d")
+	assert.Equal(t, []Header{{"c", "d", false}, {"b", "c", false}}, decoder.DynamicTableEntries())
+	assert.Equal(t, []Header{{"c", "d", false}, {"b", "c", false}}, encoder.DynamicTableEntries())
+
+	decoder.SetDynamicTableMaxSize(2*(dynamicEntryOverhead+2) - 1)
+	encoder.SetDynamicTableMaxSize(2*(dynamicEntryOverhead+2) - 1)
+	assert.Equal(t, dynamicEntryOverhead+2, decoder.dynamicTableSizeCurrent)
+	assert.Equal(t, dynamicEntryOverhead+2, encoder.dynamicTableSizeCurrent)
+}
+
+func TestEncodeEntryBiggerThanTable(t *testing.T) {
+	encoder := NewEncoder(100)
+	decoder := NewDecoder(100)
+
+	large := Header{"custom-key", "a value that is too large to fit in the dynamic table at all", false}
+	assert.Equal(t, RepresentationLiteralNotIndexed, encoder.WouldIndex(large))
+
+	for _, headers := range [][]Header{
+		{{"custom-key", "custom-value", false}},
+		{large, {"custom-key", "custom-value", false}},
+	} {
+		encoded, err := encoder.Encode(headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decoder.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, headers, decoded)
+		assert.Equal(t, encoder.DynamicTableEntries(), decoder.DynamicTableEntries())
+		assert.Equal(t, encoder.dynamicTableSizeCurrent, decoder.dynamicTableSizeCurrent)
+	}
+
+	// the existing entry is still used since the large header didn't empty the table
+	assert.Equal(t, []Header{{"custom-key", "custom-value", false}}, encoder.DynamicTableEntries())
+	encoded, err := encoder.Encode([]Header{large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(headerFieldLiteralNotIndexed), encoded[0])
 }
 
 func TestDynamicTableEntryBiggerThanTable(t *testing.T) {
 	decoder := NewDecoder(32 + 12)
 	decoder.addNewDynamicEntry("a", "b")
 	decoder.addNewDynamicEntry("aafadslkjasfdkljasfkdjlajklsfdfajklsfdjkladsfjklasjklfdf", "adfsljasfdkjlsdalkfajklsdfjkalsfdjalsdfjalksdfjaldskfjlsjk")
-	assert.Equal(t, []Header{}, decoder.dynamicTable)
+	assert.Equal(t, []Header{}, decoder.DynamicTableEntries())
+}
+
+func TestDecodeField(t *testing.T) {
+	decoder := NewDecoder(4096)
+
+	// size update, indexed :method GET, literal with incremental indexing custom-key: custom-value
+	block := []byte{0x3f, 0xe1, 0x1f, 0x82, 0x40, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79,
+		0x0c, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x76, 0x61, 0x6c, 0x75, 0x65}
+
+	rest, header, err := decoder.DecodeField(block)
+	assert.Nil(t, err)
+	assert.Nil(t, header)
+	assert.Equal(t, block[3:], rest)
+	assert.Equal(t, 4096, decoder.dynamicTableSizeMax)
+
+	rest, header, err = decoder.DecodeField(rest)
+	assert.Nil(t, err)
+	assert.Equal(t, &Header{Name: ":method", Value: "GET"}, header)
+	assert.Equal(t, block[4:], rest)
+
+	rest, header, err = decoder.DecodeField(rest)
+	assert.Nil(t, err)
+	assert.Equal(t, &Header{Name: "custom-key", Value: "custom-value"}, header)
+	assert.Empty(t, rest)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, decoder.DynamicTableEntries())
+
+	_, _, err = decoder.DecodeField(rest)
+	assert.Equal(t, ErrEmptyBlock, err)
+}
+
+func TestMaxDecodedStringLength(t *testing.T) {
+	// "0" is a 5 bit code, so 20 octets of Huffman encoded data decode to 32 octets
+	value := strings.Repeat("0", 32)
+	encoder := NewEncoder(4096)
+	encoded, err := encoder.EncodeNoDynamicIndexing(Header{Name: "custom-key", Value: value}, true)
+	assert.Nil(t, err)
+
+	decoder := NewDecoder(4096)
+	decoder.SetMaxStringLiteralLength(20)
+	headers, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: value}}, headers)
+
+	decoder.SetMaxDecodedStringLength(31)
+	_, err = decoder.Decode(encoded)
+	assert.Equal(t, ErrStringLiteralLengthTooLong, err)
+
+	decoder.SetMaxDecodedStringLength(32)
+	headers, err = decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: value}}, headers)
+
+	decoder.SetMaxDecodedStringLength(5)
+	_, err = decoder.Decode([]byte{0x00, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79, 0x00})
+	assert.Equal(t, ErrStringLiteralLengthTooLong, err)
+}
+
+func TestLastEncodeEvicted(t *testing.T) {
+	// each entry is 32 + 3 + 3 = 38 octets, so the table holds two entries
+	encoder := NewEncoder(80)
+
+	_, err := encoder.Encode([]Header{{Name: "aaa", Value: "111"}, {Name: "bbb", Value: "222"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, encoder.LastEncodeEvicted())
+
+	_, err = encoder.Encode([]Header{{Name: "ccc", Value: "333"}, {Name: "ddd", Value: "444"}, {Name: "eee", Value: "555"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, encoder.LastEncodeEvicted())
+
+	_, err = encoder.EncodeIndexed(Header{Name: "fff", Value: "666"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, encoder.LastEncodeEvicted())
+
+	// already in the table, nothing is added
+	_, err = encoder.Encode([]Header{{Name: "fff", Value: "666"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, encoder.LastEncodeEvicted())
+
+	// resizing evicts outside of an encode and isn't counted
+	encoder.SetDynamicTableMaxSize(0)
+	_, err = encoder.EncodeNoDynamicIndexing(Header{Name: "ggg", Value: "777"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, encoder.LastEncodeEvicted())
+}
+
+func TestDecodeStalled(t *testing.T) {
+	decoder := NewDecoder(4096)
+	calls := 0
+	parse := func(encoded []byte) ([]byte, *Header, error) {
+		calls += 1
+		return encoded, &Header{Name: "a", Value: "b"}, nil
+	}
+
+	headers, err := decoder.decodeWith(context.Background(), []byte{0x82}, nil, parse)
+	assert.Equal(t, ErrDecodeStalled, err)
+	assert.Nil(t, headers)
+	assert.Equal(t, 1, calls)
+}
+
+func TestAddNeverIndexedName(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.AddNeverIndexedName("authorization")
+	assert.Equal(t, RepresentationLiteralNeverIndexed, encoder.WouldIndex(Header{Name: "authorization", Value: "secret"}))
+
+	encoded, err := encoder.EncodeTrusted([]Header{{Name: "authorization", Value: "secret"}, {Name: "custom-key", Value: "custom-value"}}, false)
+	assert.Nil(t, err)
+	// authorization is static index 23, which needs a continuation octet with a 4 bit prefix
+	assert.Equal(t, []byte{0x1f, 0x08, 0x06}, encoded[:3])
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, encoder.DynamicTableEntries())
+
+	decoder := NewDecoder(4096)
+	fields, err := decoder.DecodeFields(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{
+		{Header: Header{Name: "authorization", Value: "secret", Sensitive: true}, Representation: RepresentationLiteralNeverIndexed},
+		{Header: Header{Name: "custom-key", Value: "custom-value"}, Representation: RepresentationLiteralIncrementalIndexing},
+	}, fields)
+}
+
+func TestAddNeverIndexedNameWithNormalizedNames(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.AddNeverIndexedName("Authorization")
+	encoder.SetNormalizeNames(true)
+	assert.Equal(t, RepresentationLiteralNeverIndexed, encoder.WouldIndex(Header{Name: "Authorization", Value: "secret"}))
+
+	encoded, err := encoder.Encode([]Header{{Name: "Authorization", Value: "secret"}, {Name: "authorization", Value: "secret"}})
+	assert.Nil(t, err)
+	assert.Empty(t, encoder.DynamicTableEntries())
+
+	headers, err := NewDecoder(4096).Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{
+		{Name: "authorization", Value: "secret", Sensitive: true},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}, headers)
+}
+
+func TestSetSensitivePredicate(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetSensitivePredicate(func(name string) bool {
+		return strings.HasPrefix(name, "x-secret-")
+	})
+	assert.Equal(t, RepresentationLiteralNeverIndexed, encoder.WouldIndex(Header{Name: "x-secret-token", Value: "abc"}))
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{Name: "x-public", Value: "abc"}))
+
+	encoded, err := encoder.EncodeTrusted([]Header{{Name: "x-secret-token", Value: "abc"}}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x10), encoded[0])
+	assert.Empty(t, encoder.DynamicTableEntries())
+
+	decoder := NewDecoder(4096)
+	fields, err := decoder.DecodeFields(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{
+		{Header: Header{Name: "x-secret-token", Value: "abc", Sensitive: true}, Representation: RepresentationLiteralNeverIndexed},
+	}, fields)
+
+	encoder.SetSensitivePredicate(nil)
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{Name: "x-secret-token", Value: "abc"}))
+}
+
+func TestDecodeIntegerMaskedFirstOctet(t *testing.T) {
+	decoder := NewDecoder(4096)
+	tests := []struct {
+		octet        byte
+		prefixLength int
+		masked       int
+		number       int
+	}{
+		{0x82, 7, headerFieldIndexed, 2},
+		{0x41, 6, headerFieldLiteralIncrementalIndex, 1},
+		{0x3e, 5, headerFieldDynamicSizeUpdate, 30},
+		{0x1a, 4, headerFieldLiteralNeverIndexed, 10},
+		{0x04, 4, headerFieldLiteralNotIndexed, 4},
+		{0x8c, 7, huffmanEncoded, 12},
+		{0x0c, 7, 0, 12},
+	}
+	for _, test := range tests {
+		rest, masked, number, err := decoder.DecodeInteger([]byte{test.octet}, test.prefixLength)
+		assert.Nil(t, err)
+		assert.Empty(t, rest)
+		assert.Equal(t, test.masked, masked, "octet %02x", test.octet)
+		assert.Equal(t, test.number, number)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	encodedHexValues := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	decoder := NewDecoder(4096)
+	advanceDecoder := NewDecoder(4096)
+	for _, hexValue := range encodedHexValues {
+		block, err := hex.DecodeString(hexValue)
+		assert.Nil(t, err)
+
+		_, err = decoder.Decode(block)
+		assert.Nil(t, err)
+		assert.Nil(t, advanceDecoder.Advance(block))
+		assert.Equal(t, decoder.DynamicTableEntries(), advanceDecoder.DynamicTableEntries())
+		assert.Equal(t, decoder.dynamicTableSizeCurrent, advanceDecoder.dynamicTableSizeCurrent)
+	}
+	assert.Equal(t, 3, len(advanceDecoder.DynamicTableEntries()))
+
+	assert.NotNil(t, advanceDecoder.Advance([]byte{0xff, 0x00}))
+}
+
+func TestDecodeFromReader(t *testing.T) {
+	blocks := []string{
+		// C.3 without Huffman coding
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684be58086e6f2d6361636865",
+		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+		// C.4 with Huffman coding
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	for _, blocks := range [][]string{blocks[:3], blocks[3:]} {
+		decoder := NewDecoder(4096)
+		readerDecoder := NewDecoder(4096)
+		for _, hexValue := range blocks {
+			block, err := hex.DecodeString(hexValue)
+			assert.Nil(t, err)
+
+			expected, err := decoder.Decode(block)
+			assert.Nil(t, err)
+			headers := make([]Header, 0)
+			err = readerDecoder.DecodeFromReader(iotest.OneByteReader(bytes.NewReader(block)), func(header Header) error {
+				headers = append(headers, header)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, expected, headers)
+			assert.Equal(t, decoder.DynamicTableEntries(), readerDecoder.DynamicTableEntries())
+		}
+	}
+
+	emit := func(Header) error { return nil }
+	decoder := NewDecoder(4096)
+	block, _ := hex.DecodeString(blocks[0])
+	// the block ends in the middle of the value of :authority
+	assert.Equal(t, ErrStringLiteralTruncated, decoder.DecodeFromReader(bytes.NewReader(block[:len(block)-1]), emit))
+	assert.Equal(t, ErrIntegerTruncated, decoder.DecodeFromReader(bytes.NewReader([]byte{0x82, 0xff}), emit))
+	assert.Nil(t, decoder.DecodeFromReader(bytes.NewReader([]byte{}), emit))
+	decoder.SetRejectEmptyBlock(true)
+	assert.Equal(t, ErrEmptyBlock, decoder.DecodeFromReader(bytes.NewReader([]byte{}), emit))
+
+	stop := errors.New("stop")
+	emitted := 0
+	err := NewDecoder(4096).DecodeFromReader(bytes.NewReader(block), func(Header) error {
+		emitted++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, emitted)
+}
+
+func TestDecodeFromReaderSkipOversizeString(t *testing.T) {
+	literal := strings.Repeat("a", 1<<20)
+	tests := []struct {
+		name   string
+		prefix []byte
+		suffix []byte
+	}{
+		// a literal name followed by a value that is read and dropped with the field
+		{"name", []byte{0x00}, []byte{0x0c, 'c', 'u', 's', 't', 'o', 'm', '-', 'v', 'a', 'l', 'u', 'e'}},
+		// never indexed :path
+		{"value", []byte{0x14}, nil},
+	}
+	for _, test := range tests {
+		block := appendInteger(append([]byte{}, test.prefix...), len(literal), stringLengthPrefix, 0)
+		tail := append(append([]byte{}, test.suffix...), 0x82)
+
+		decoder := NewDecoder(4096)
+		decoder.SetMaxStringLiteralLength(16)
+		decoder.SetOversizeStringPolicy(PolicySkip)
+		headers := make([]Header, 0)
+		emit := func(header Header) error {
+			headers = append(headers, header)
+			return nil
+		}
+		r := iotest.OneByteReader(io.MultiReader(bytes.NewReader(block), strings.NewReader(literal), bytes.NewReader(tail)))
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		assert.Nil(t, decoder.DecodeFromReader(r, emit), test.name)
+		runtime.ReadMemStats(&after)
+		assert.Equal(t, []Header{{Name: ":method", Value: "GET"}}, headers, test.name)
+		// the skipped literal is never buffered
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(literal)/4), test.name)
+
+		// the block ends in the middle of the skipped literal
+		r = io.MultiReader(bytes.NewReader(block), strings.NewReader(literal[:100]))
+		assert.Equal(t, ErrStringLiteralTruncated, decoder.DecodeFromReader(r, emit), test.name)
+	}
+}
+
+func TestDecodeErrorsIs(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+		err   error
+	}{
+		{"index zero", []byte{0x80}, ErrIndexNotFound},
+		{"index past the dynamic table", []byte{0xff, 0x00}, ErrIndexNotFound},
+		{"name index past the dynamic table", []byte{0x7f, 0x10, 0x01, 0x61}, ErrIndexNotFound},
+		{"size update over limit", []byte{0x3f, 0xe2, 0x1f}, ErrDynamicTableSizeTooLarge},
+		{"truncated huffman code", []byte{0x04, 0x81, 0xff}, ErrHuffmanTruncated},
+		{"truncated huffman code is a huffman failure", []byte{0x04, 0x81, 0xff}, ErrHuffmanDecodeFailure},
+		{"truncated string literal", []byte{0x04, 0x85, 0x60}, ErrStringLiteralTruncated},
+		{"truncated integer", []byte{0x82, 0xff}, ErrIntegerTruncated},
+	}
+	for _, test := range tests {
+		_, err := NewDecoder(4096).Decode(test.block)
+		assert.True(t, errors.Is(err, test.err), "%s: %v", test.name, err)
+	}
+
+	encoder := NewEncoder(4096)
+	_, err := encoder.EncodePlanned([]FieldPlan{{Header: Header{Name: "a", Value: "b"}, Representation: RepresentationIndexed, Index: 62}})
+	assert.True(t, errors.Is(err, ErrIndexNotFound))
+}
+
+func TestSetEntrySizeFunc(t *testing.T) {
+	// three times the overhead of the RFC
+	entrySize := func(name string, value string) int {
+		return 96 + len(name) + len(value)
+	}
+	headers := []Header{
+		{Name: "custom-key", Value: "custom-value-1"},
+		{Name: "custom-key", Value: "custom-value-2"},
+		{Name: "custom-key", Value: "custom-value-3"},
+	}
+
+	encoder := NewEncoder(256)
+	decoder := NewDecoder(256)
+	encoded, err := encoder.Encode(headers)
+	assert.Nil(t, err)
+	_, err = decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(decoder.DynamicTableEntries()))
+
+	// only two entries of 120 octets fit
+	encoder = NewEncoder(256)
+	encoder.SetEntrySizeFunc(entrySize)
+	decoder = NewDecoder(256)
+	decoder.SetEntrySizeFunc(entrySize)
+	evicted := make([]Header, 0)
+	decoder.SetOnEvict(func(header Header) {
+		evicted = append(evicted, header)
+	})
+	encoded, err = encoder.Encode(headers)
+	assert.Nil(t, err)
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, []Header{headers[2], headers[1]}, decoder.DynamicTableEntries())
+	assert.Equal(t, []Header{headers[0]}, evicted)
+	assert.Equal(t, 240, decoder.dynamicTableSizeCurrent)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+
+	// restoring the default size keeps the entries and corrects the size
+	decoder.SetEntrySizeFunc(nil)
+	assert.Equal(t, 2, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 112, decoder.dynamicTableSizeCurrent)
+}
+
+func TestSetIndexingPolicy(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetIndexingPolicy(func(header Header, seenNameBefore bool) bool {
+		return seenNameBefore
+	})
+	decoder := NewDecoder(4096)
+
+	steps := []struct {
+		header         Header
+		representation Representation
+	}{
+		{Header{Name: "custom-key", Value: "a"}, RepresentationLiteralNotIndexed},
+		{Header{Name: "custom-key", Value: "b"}, RepresentationLiteralIncrementalIndexing},
+		{Header{Name: "custom-key", Value: "b"}, RepresentationIndexed},
+		{Header{Name: "other-key", Value: "b"}, RepresentationLiteralNotIndexed},
+		// static table entries aren't affected
+		{Header{Name: ":method", Value: "GET"}, RepresentationIndexed},
+	}
+	for _, step := range steps {
+		assert.Equal(t, step.representation, encoder.WouldIndex(step.header), step.header.String())
+		encoded, err := encoder.EncodeTrusted([]Header{step.header}, false)
+		assert.Nil(t, err)
+		fields, err := decoder.DecodeFields(encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, step.representation, fields[0].Representation, step.header.String())
+	}
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "b"}}, encoder.DynamicTableEntries())
+
+	// setting the policy again forgets the names
+	encoder.SetIndexingPolicy(func(header Header, seenNameBefore bool) bool {
+		return seenNameBefore
+	})
+	assert.Equal(t, RepresentationLiteralNotIndexed, encoder.WouldIndex(Header{Name: "other-key", Value: "c"}))
+	encoder.SetIndexingPolicy(nil)
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(Header{Name: "other-key", Value: "c"}))
+}
+
+func TestEncodeResponse(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+	headers := []Header{{Name: "content-type", Value: "text/plain"}}
+
+	encoded, err := encoder.EncodeResponse(200, headers, false)
+	assert.Nil(t, err)
+	// :status 200 is static index 8
+	assert.Equal(t, byte(0x88), encoded[0])
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "text/plain"}}, decoded)
+
+	encoded, err = encoder.EncodeResponse(418, nil, false)
+	assert.Nil(t, err)
+	// a literal with the name of static index 8
+	assert.Equal(t, []byte{0x48, 0x03, '4', '1', '8'}, encoded)
+	decoded, err = decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":status", Value: "418"}}, decoded)
+
+	for _, status := range []int{-1, 0, 99, 600, 1000} {
+		encoded, err = encoder.EncodeResponse(status, headers, false)
+		assert.Equal(t, ErrInvalidStatus, err)
+		assert.Nil(t, encoded)
+	}
+}
+
+func TestReEncode(t *testing.T) {
+	// :method GET indexed, custom-key: custom-header with incremental indexing (C.2.1),
+	// :path /sample/path without indexing (C.2.2) and password: secret never indexed (C.2.3)
+	block, _ := hex.DecodeString("82" +
+		"400a637573746f6d2d6b65790d637573746f6d2d686561646572" +
+		"040c2f73616d706c652f70617468" +
+		"100870617373776f726406736563726574")
+	fields, err := NewDecoder(4096).DecodeFields(block)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fields))
+
+	encoder := NewEncoder(4096)
+	reEncoded := make([]byte, 0)
+	for _, field := range fields {
+		encoded, err := encoder.ReEncode(field, true)
+		assert.Nil(t, err)
+		reEncoded = append(reEncoded, encoded...)
+	}
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-header"}}, encoder.DynamicTableEntries())
+
+	reDecoded, err := NewDecoder(4096).DecodeFields(reEncoded)
+	assert.Nil(t, err)
+	assert.Equal(t, fields, reDecoded)
+
+	// the entry is now in the encoder's dynamic table
+	encoded, err := encoder.ReEncode(fields[1], true)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xbe}, encoded)
+
+	_, err = encoder.ReEncode(HeaderField{Representation: RepresentationDynamicTableSizeUpdate}, true)
+	assert.EqualError(t, err, "can't re-encode a header field decoded as dynamic table size update")
+}
+
+func TestFlushPendingSizeUpdate(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+	assert.Equal(t, []byte{}, encoder.FlushPendingSizeUpdate())
+
+	encoder.SetDynamicTableMaxSize(0)
+	encoder.SetDynamicTableMaxSize(256)
+	flushed := encoder.FlushPendingSizeUpdate()
+	// an update to 0 followed by an update to 256
+	assert.Equal(t, []byte{0x20, 0x3f, 0xe1, 0x01}, flushed)
+	assert.Equal(t, []byte{}, encoder.FlushPendingSizeUpdate())
+	assert.Equal(t, 4, encoder.Stats().EncodedBytes)
+
+	headers := []Header{{Name: ":method", Value: "GET"}}
+	encoded, err := encoder.Encode(headers)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x82}, encoded)
+
+	decoded, err := decoder.Decode(append(flushed, encoded...))
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, 256, decoder.dynamicTableSizeMax)
+}
+
+func TestStringInterner(t *testing.T) {
+	interned := make(map[string]string)
+	calls := make([]string, 0)
+	interner := func(s string) string {
+		calls = append(calls, s)
+		if shared, ok := interned[s]; ok {
+			return shared
+		}
+		interned[s] = s
+		return s
+	}
+
+	// https://tools.ietf.org/html/rfc7541#appendix-C.4, a new decoder for each block
+	// so the values are literals every time
+	for _, hexValue := range []string{"828684418cf1e3c2e5f23a6ba0ab90f4ff", "828684418cf1e3c2e5f23a6ba0ab90f4ff"} {
+		decoder := NewDecoder(4096)
+		decoder.SetStringInterner(interner)
+		block, _ := hex.DecodeString(hexValue)
+		headers, err := decoder.Decode(block)
+		assert.Nil(t, err)
+		assert.Equal(t, Header{Name: ":authority", Value: "www.example.com"}, headers[3])
+	}
+	assert.Equal(t, []string{"www.example.com", "www.example.com"}, calls)
+	assert.Equal(t, 1, len(interned))
+
+	// literal names are interned too
+	decoder := NewDecoder(4096)
+	decoder.SetStringInterner(interner)
+	headers, err := decoder.Decode([]byte{0x00, 0x01, 'a', 0x01, 'b'})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "a", Value: "b"}}, headers)
+	assert.Equal(t, []string{"www.example.com", "www.example.com", "a", "b"}, calls)
+
+	decoder.SetStringInterner(nil)
+	_, err = decoder.Decode([]byte{0x00, 0x01, 'a', 0x01, 'b'})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(calls))
+}
+
+func TestValidate(t *testing.T) {
+	decoder := NewDecoder(4096)
+	inserted := 0
+	decoder.SetOnInsert(func(Header) { inserted++ })
+
+	first, _ := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	second, _ := hex.DecodeString("828684be5886a8eb10649cbf")
+	assert.Nil(t, decoder.Validate(first))
+	assert.Nil(t, decoder.Validate([]byte{}))
+	// the second block references an entry that is only added by the first block
+	assert.NotNil(t, decoder.Validate(second))
+	assert.Empty(t, decoder.DynamicTableEntries())
+	assert.Equal(t, 0, decoder.dynamicTableSizeCurrent)
+	assert.Equal(t, 0, inserted)
+
+	_, err := decoder.Decode(first)
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.Validate(second))
+	assert.Equal(t, 1, len(decoder.DynamicTableEntries()))
+
+	malformed := map[string][]byte{
+		"index zero":              {0x80},
+		"index out of range":      {0xff, 0x00},
+		"name index out of range": {0x7f, 0x10, 0x01, 0x61},
+		"size update over limit":  {0x3f, 0xe2, 0x1f},
+		"truncated huffman":       {0x04, 0x85, 0x60},
+		"invalid huffman padding": {0x04, 0x81, 0x00},
+	}
+	for name, block := range malformed {
+		assert.NotNil(t, decoder.Validate(block), name)
+	}
+	assert.Equal(t, 1, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 4096, decoder.dynamicTableSizeMax)
+}
+
+func TestDecodeFieldIndexNotFoundRest(t *testing.T) {
+	decoder := NewDecoder(4096)
+
+	// index 127 needs a continuation octet, :path / follows
+	rest, header, err := decoder.DecodeField([]byte{0xff, 0x00, 0x84})
+	assert.True(t, errors.Is(err, ErrIndexNotFound))
+	assert.Nil(t, header)
+	assert.Equal(t, []byte{0x84}, rest)
+
+	rest, header, err = decoder.DecodeField([]byte{0x80})
+	assert.True(t, errors.Is(err, ErrIndexNotFound))
+	assert.Nil(t, header)
+	assert.Equal(t, []byte{}, rest)
+
+	// a truncated index has no position to return
+	rest, _, err = decoder.DecodeField([]byte{0xff, 0x80})
+	assert.Equal(t, ErrIntegerTruncated, err)
+	assert.Nil(t, rest)
+
+	// Decode still fails the whole block
+	headers, err := decoder.Decode([]byte{0xff, 0x00, 0x84})
+	assert.NotNil(t, err)
+	assert.Nil(t, headers)
+}
+
+func TestLenientIndexErrors(t *testing.T) {
+	// :method GET, an index past the end of the empty dynamic table, :path /
+	block := []byte{0x82, 0xff, 0x00, 0x84}
+
+	decoder := NewDecoder(4096)
+	_, err := decoder.Decode(block)
+	assert.NotNil(t, err)
+
+	var events []DecodeEvent
+	decoder.SetLenientIndexErrors(true)
+	decoder.SetTracer(func(event DecodeEvent) {
+		events = append(events, event)
+	})
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}}, headers)
+	assert.Equal(t, DecodeEvent{Type: EventSkippedIndex, Representation: RepresentationIndexed, Index: 127}, events[1])
+	assert.Equal(t, "skipped index", events[1].Type.String())
+	assert.NotNil(t, decoder.Validate(block))
+
+	// index 0 is skipped too, but literal fields with an out of range name index still fail
+	headers, err = decoder.Decode([]byte{0x80})
+	assert.Nil(t, err)
+	assert.Empty(t, headers)
+	_, err = decoder.Decode([]byte{0x7f, 0x10, 0x01, 0x61})
+	assert.NotNil(t, err)
+}
+
+func TestEncodeWithBudget(t *testing.T) {
+	headers := []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "custom-key-2", Value: "custom-value-2"},
+	}
+
+	encoder := NewEncoder(4096)
+	full, err := NewEncoder(4096).EncodeTrusted(headers, false)
+	assert.Nil(t, err)
+
+	// :method GET is 1 octet and custom-key: custom-value is 25 octets
+	encoded, remaining, err := encoder.EncodeWithBudget(headers, 26, false)
+	assert.Nil(t, err)
+	assert.Equal(t, full[:26], encoded)
+	assert.Equal(t, headers[2:], remaining)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, encoder.DynamicTableEntries())
+
+	encoded, remaining, err = encoder.EncodeWithBudget(remaining, 26, false)
+	assert.Nil(t, err)
+	assert.Empty(t, encoded)
+	assert.Equal(t, headers[2:], remaining)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, encoder.DynamicTableEntries())
+
+	encoded, remaining, err = encoder.EncodeWithBudget(remaining, len(full)-26, false)
+	assert.Nil(t, err)
+	assert.Equal(t, full[26:], encoded)
+	assert.Nil(t, remaining)
+
+	decoder := NewDecoder(4096)
+	decoded, err := decoder.Decode(full)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, decoder.DynamicTableEntries(), encoder.DynamicTableEntries())
+}
+
+func TestEncodeWithBudgetSizeUpdate(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetDynamicTableMaxSize(256)
+
+	// the pending size update counts against the budget and is kept until a header is encoded
+	encoded, remaining, err := encoder.EncodeWithBudget([]Header{{Name: ":method", Value: "GET"}}, 2, false)
+	assert.Nil(t, err)
+	assert.Empty(t, encoded)
+	assert.Equal(t, 1, len(remaining))
+
+	encoded, remaining, err = encoder.EncodeWithBudget(remaining, 4, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3f, 0xe1, 0x01, 0x82}, encoded)
+	assert.Nil(t, remaining)
+}
+
+func TestEncodeWithBudgetInvalidHeader(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetValidateHeaders(true)
+	encoder.SetDynamicTableMaxSize(256)
+
+	// the invalid header doesn't fit in the budget but is still validated
+	encoded, remaining, err := encoder.EncodeWithBudget([]Header{
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "custom-key-2", Value: "custom-value-2\r\n"},
+		{Name: "custom-key-3", Value: "custom-value-3"},
+	}, 64, false)
+	assert.Equal(t, ErrInvalidHeaderValue, err)
+	assert.Nil(t, encoded)
+	assert.Nil(t, remaining)
+	assert.Empty(t, encoder.DynamicTableEntries())
+
+	decoder := NewDecoder(4096)
+	headers := []Header{{Name: "custom-key", Value: "custom-value"}}
+	encoded, remaining, err = encoder.EncodeWithBudget(headers, 64, false)
+	assert.Nil(t, err)
+	assert.Nil(t, remaining)
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+}
+
+func TestValidatePseudoHeaderOrder(t *testing.T) {
+	// nothing is indexed so each block can be decoded on its own
+	encoder := NewEncoder(0)
+	valid, err := encoder.Encode([]Header{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}, {Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	invalid, err := encoder.Encode([]Header{{Name: ":method", Value: "GET"}, {Name: "custom-key", Value: "custom-value"}, {Name: ":path", Value: "/"}})
+	assert.Nil(t, err)
+
+	decoder := NewDecoder(4096)
+	_, err = decoder.Decode(valid)
+	assert.Nil(t, err)
+	_, err = decoder.Decode(invalid)
+	assert.Nil(t, err)
+
+	decoder = NewDecoder(4096)
+	decoder.SetValidatePseudoHeaderOrder(true)
+	headers, err := decoder.Decode(valid)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(headers))
+	_, err = decoder.Decode(invalid)
+	assert.Equal(t, ErrPseudoHeaderAfterRegular, err)
+
+	// the order is tracked per block
+	block, err := encoder.Encode([]Header{{Name: ":status", Value: "200"}})
+	assert.Nil(t, err)
+	_, err = decoder.Decode(block)
+	assert.Nil(t, err)
+
+	_, err = NewDecoder(4096).DecodeFields(invalid)
+	assert.Nil(t, err)
+	decoder = NewDecoder(4096)
+	decoder.SetValidatePseudoHeaderOrder(true)
+	_, err = decoder.DecodeFields(invalid)
+	assert.Equal(t, ErrPseudoHeaderAfterRegular, err)
+}
+
+func TestRejectUnknownPseudoHeaders(t *testing.T) {
+	encoder := NewEncoder(4096)
+	block, err := encoder.Encode([]Header{{Name: ":method", Value: "CONNECT"}, {Name: ":protocol", Value: "websocket"}, {Name: ":foo", Value: "bar"}})
+	assert.Nil(t, err)
+
+	decoder := NewDecoder(4096)
+	_, err = decoder.Decode(block)
+	assert.Nil(t, err)
+
+	decoder = NewDecoder(4096)
+	decoder.SetRejectUnknownPseudoHeaders(true)
+	_, err = decoder.Decode(block)
+	assert.Equal(t, ErrUnknownPseudoHeader, err)
+}
+
+func TestDecodeIntegerRaisedEncodedLength(t *testing.T) {
+	// 1<<40 needs 6 continuation octets with a 5 bit prefix, 1<<48 needs 7
+	sevenOctets := encodeInteger(1<<40, 5)
+	eightOctets := encodeInteger(1<<48, 5)
+	assert.Equal(t, 7, len(sevenOctets))
+	assert.Equal(t, 8, len(eightOctets))
+
+	decoder := NewDecoder(4096)
+	decoder.SetMaxIntegerValue(maxInt)
+	_, _, _, err := decoder.DecodeInteger(sevenOctets, 5)
+	assert.Equal(t, ErrIntegerEncodedLengthTooLong, err)
+
+	decoder.SetMaxIntegerEncodedLength(7)
+	rest, _, number, err := decoder.DecodeInteger(sevenOctets, 5)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, 1<<40, number)
+	_, _, _, err = decoder.DecodeInteger(eightOctets, 5)
+	assert.Equal(t, ErrIntegerEncodedLengthTooLong, err)
+
+	decoder.SetMaxIntegerEncodedLength(10)
+	rest, _, number, err = decoder.DecodeInteger(eightOctets, 5)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, 1<<48, number)
+
+	encoded := encodeInteger(maxInt, 5)
+	assert.Equal(t, 10, len(encoded))
+	_, _, number, err = decoder.DecodeInteger(encoded, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, maxInt, number)
+
+	// one more than the largest int still overflows with a raised limit
+	assert.Equal(t, []byte{0x1f, 0xe0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, encoded)
+	_, _, _, err = decoder.DecodeInteger([]byte{0x1f, 0xe1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, 5)
+	assert.Equal(t, ErrIntegerValueTooLarge, err)
+}
+
+func TestStringLiteralLengthPrefixBoundary(t *testing.T) {
+	tests := []struct {
+		length int
+		prefix []byte
+	}{
+		{126, []byte{0x7e}},
+		// 127 fills the prefix, so a continuation octet of 0 is needed
+		{127, []byte{0x7f, 0x00}},
+		{128, []byte{0x7f, 0x01}},
+	}
+	decoder := NewDecoder(4096)
+	for _, test := range tests {
+		str := strings.Repeat("x", test.length)
+		encoded := encodeLiteralString(str, stringLengthPrefix, false)
+		assert.Equal(t, test.prefix, encoded[:len(test.prefix)], "%d", test.length)
+		assert.Equal(t, len(test.prefix)+test.length, len(encoded), "%d", test.length)
+
+		rest, decoded, err := decoder.readPrefixedLengthString(append(encoded, 0x82), stringLengthPrefix)
+		assert.Nil(t, err, "%d", test.length)
+		assert.Equal(t, str, decoded, "%d", test.length)
+		assert.Equal(t, []byte{0x82}, rest, "%d", test.length)
+
+		// '0' has a 5 bit code, so 8 of them are 5 octets
+		huffmanStr := strings.Repeat("0", test.length*8/5)
+		encoded = encodeLiteralString(huffmanStr, stringLengthPrefix, true)
+		assert.Equal(t, test.prefix[0]|huffmanEncoded, encoded[0], "%d", test.length)
+		assert.Equal(t, len(test.prefix)+test.length, len(encoded), "%d", test.length)
+		_, decoded, err = decoder.readPrefixedLengthString(encoded, stringLengthPrefix)
+		assert.Nil(t, err, "%d", test.length)
+		assert.Equal(t, huffmanStr, decoded, "%d", test.length)
+
+		// a literal header field without indexing with the string as the name and value
+		block := append([]byte{0x00}, encodeLiteralString(str, stringLengthPrefix, false)...)
+		block = append(block, encodeLiteralString(str, stringLengthPrefix, false)...)
+		headers, err := decoder.Decode(block)
+		assert.Nil(t, err, "%d", test.length)
+		assert.Equal(t, []Header{{Name: str, Value: str}}, headers, "%d", test.length)
+	}
+}
+
+func TestZeroLengthLiterals(t *testing.T) {
+	decoded, err := HuffmanDecode([]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, decoded)
+
+	decoder := NewDecoder(4096)
+	rest, str, err := decoder.readPrefixedLengthString([]byte{0x00, 0x82}, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, "", str)
+	assert.Equal(t, []byte{0x82}, rest)
+
+	rest, str, err = decoder.readPrefixedLengthString([]byte{0x80, 0x82}, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, "", str)
+	assert.Equal(t, []byte{0x82}, rest)
+
+	// literal without indexing, custom-key with an empty raw value and an empty Huffman value
+	headers, err := decoder.Decode([]byte{0x00, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79, 0x00,
+		0x00, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79, 0x80})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: ""}, {Name: "custom-key", Value: ""}}, headers)
+
+	// an empty name is decoded as is
+	headers, err = decoder.Decode([]byte{0x00, 0x80, 0x80})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "", Value: ""}}, headers)
+}
+
+func TestGetIndexedNameValueOutOfRange(t *testing.T) {
+	decoder := NewDecoder(256)
+	for _, index := range []int{0, -1, -62} {
+		name, value, err := decoder.getIndexedNameValue(index)
+		assert.EqualError(t, err, fmt.Sprintf("index not found: index %d is out of range of the static table (61 entries)", index))
+		assert.Equal(t, "", name)
+		assert.Equal(t, "", value)
+	}
+
+	name, value, err := decoder.getIndexedNameValue(61)
+	assert.Nil(t, err)
+	assert.Equal(t, "www-authenticate", name)
+	assert.Equal(t, "", value)
+}
+
+func TestDecodeToMap(t *testing.T) {
+	encoder := NewEncoder(4096)
+	block, err := encoder.Encode([]Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "cookie", Value: "a=b"},
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "cookie", Value: "c=d", Sensitive: true},
+	})
+	assert.Nil(t, err)
+
+	decoder := NewDecoder(4096)
+	values, err := decoder.DecodeToMap(block)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		":method":    {"GET"},
+		"cookie":     {"a=b", "c=d"},
+		"custom-key": {"custom-value"},
+	}, values)
+
+	values, err = decoder.DecodeToMap([]byte{0xff, 0x00})
+	assert.NotNil(t, err)
+	assert.Nil(t, values)
+}
+
+func TestIncrementalIndexInvalidNameIndex(t *testing.T) {
+	decoder := NewDecoder(4096)
+	decoder.addNewDynamicEntry("custom-key", "custom-value")
+	entries := decoder.DynamicTableEntries()
+	size := decoder.dynamicTableSizeCurrent
+
+	// literal with incremental indexing, name index 63 followed by the value "a"
+	_, err := decoder.Decode([]byte{0x7f, 0x00, 0x01, 0x61})
+	assert.EqualError(t, err, "index not found: index 63 is past the end of the dynamic table (dynamic index 2, 1 entries)")
+	assert.Equal(t, entries, decoder.DynamicTableEntries())
+	assert.Equal(t, size, decoder.dynamicTableSizeCurrent)
+
+	// the same field referencing the existing dynamic entry is inserted
+	headers, err := decoder.Decode([]byte{0x7e, 0x01, 0x61})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "a"}}, headers)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "a"}, {Name: "custom-key", Value: "custom-value"}}, decoder.DynamicTableEntries())
+}
+
+func TestEncodeWithOffsets(t *testing.T) {
+	headers := []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "password", Value: "secret", Sensitive: true},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+	encoder := NewEncoder(4096)
+	encoder.SetDynamicTableMaxSize(256)
+	encoded, offsets, err := encoder.EncodeWithOffsets(headers, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(offsets))
+	assert.Equal(t, 0, offsets[0])
+
+	expected, err := NewDecoder(4096).Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, expected)
+
+	decoder := NewDecoder(4096)
+	for x, offset := range offsets {
+		end := len(encoded)
+		if x+1 < len(offsets) {
+			end = offsets[x+1]
+		}
+		decoded, err := decoder.Decode(encoded[offset:end])
+		assert.Nil(t, err)
+		assert.Equal(t, []Header{headers[x]}, decoded)
+	}
+	assert.Equal(t, 256, decoder.dynamicTableSizeMax)
+}
+
+func TestEncodeWithOffsetsInvalidHeader(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetValidateHeaders(true)
+	encoder.SetDynamicTableMaxSize(256)
+
+	encoded, offsets, err := encoder.EncodeWithOffsets([]Header{
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "custom key", Value: "custom-value"},
+	}, true)
+	assert.Equal(t, ErrInvalidHeaderName, err)
+	assert.Nil(t, encoded)
+	assert.Nil(t, offsets)
+	assert.Empty(t, encoder.DynamicTableEntries())
+
+	decoder := NewDecoder(4096)
+	headers := []Header{{Name: "custom-key", Value: "custom-value"}}
+	encoded, _, err = encoder.EncodeWithOffsets(headers, true)
+	assert.Nil(t, err)
+	decoded, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+}
+
+func TestSetUseStaticValueMatch(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoded, err := encoder.EncodeNoDynamicIndexing(Header{Name: ":method", Value: "GET"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x82}, encoded)
+
+	encoder.SetUseStaticValueMatch(false)
+	encoded, err = encoder.EncodeNoDynamicIndexing(Header{Name: ":method", Value: "GET"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x02, 0x03, 'G', 'E', 'T'}, encoded)
+
+	// the dynamic table is still matched by name and value
+	encoded, err = encoder.EncodeTrusted([]Header{{Name: ":method", Value: "GET"}, {Name: ":method", Value: "GET"}}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x42, 0x03, 'G', 'E', 'T', 0xbe}, encoded)
+}
+
+func TestApplySettings(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+	block, err := encoder.Encode([]Header{{Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	_, err = decoder.Decode(block)
+	assert.Nil(t, err)
+
+	// the decoder's side sends SETTINGS_HEADER_TABLE_SIZE 0 followed by 256 before the encoder
+	// encodes the next block, the table is emptied and both sizes are sent
+	decoder.ApplySettings(256)
+	assert.Equal(t, 4096, decoder.dynamicTableSizeMax)
+	assert.Equal(t, 256, decoder.dynamicTableSizeLimit)
+	assert.Equal(t, 1, len(decoder.DynamicTableEntries()))
+
+	encoder.ApplySettings(0)
+	encoder.ApplySettings(256)
+	assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+	block, err = encoder.Encode([]Header{{Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x20, 0x3f, 0xe1, 0x01}, block[:4])
+
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, headers)
+	assert.Equal(t, 256, decoder.dynamicTableSizeMax)
+	assert.Equal(t, encoder.DynamicTableEntries(), decoder.DynamicTableEntries())
+
+	// an update above the settings value is rejected
+	decoder.ApplySettings(128)
+	_, err = decoder.Decode([]byte{0x3f, 0xe1, 0x01})
+	assert.NotNil(t, err)
+}
+
+func TestDecoderSetDynamicTableMaxSizeKeepsLimit(t *testing.T) {
+	decoder := NewDecoder(4096)
+	decoder.ApplySettings(128)
+	assert.Nil(t, decoder.SetDynamicTableMaxSize(256))
+	assert.Equal(t, 256, decoder.dynamicTableSizeMax)
+	assert.Equal(t, 128, decoder.dynamicTableSizeLimit)
+
+	// the settings value still limits size updates from the encoder
+	_, err := decoder.Decode(encodeDynamicTableSizeUpdate(256))
+	assert.ErrorIs(t, err, ErrDynamicTableSizeTooLarge)
+	_, err = decoder.Decode(encodeDynamicTableSizeUpdate(128))
+	assert.Nil(t, err)
+}
+
+func TestAssertTablesMatch(t *testing.T) {
+	encoder := NewEncoder(128)
+	decoder := NewDecoder(128)
+	blocks := [][]Header{
+		{{Name: ":method", Value: "GET"}, {Name: "custom-key", Value: "custom-value"}},
+		{{Name: "custom-key", Value: "custom-value"}, {Name: "a", Value: "b"}},
+		{{Name: "c", Value: "d"}, {Name: "password", Value: "secret", Sensitive: true}, {Name: "e", Value: "f"}},
+	}
+	for _, headers := range blocks {
+		block, err := encoder.Encode(headers)
+		assert.Nil(t, err)
+		assert.NotNil(t, AssertTablesMatch(encoder, decoder))
+		_, err = decoder.Decode(block)
+		assert.Nil(t, err)
+		assert.Nil(t, AssertTablesMatch(encoder, decoder))
+	}
+
+	decoder.addNewDynamicEntry("g", "h")
+	assert.EqualError(t, AssertTablesMatch(encoder, decoder), `dynamic tables differ: `+
+		`index 62: encoder has "e: f", decoder has "g: h"; `+
+		`index 63: encoder has "c: d", decoder has "e: f"; `+
+		`index 64: encoder has "a: b", decoder has "c: d"`)
+}
+
+func TestAssertTablesMatchLength(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(256)
+	encoder.addNewDynamicEntry("a", "b")
+	assert.EqualError(t, AssertTablesMatch(encoder, decoder), `dynamic tables differ: `+
+		`encoder has 1 entries, decoder has 0 entries; `+
+		`encoder max size is 4096, decoder max size is 256; `+
+		`index 62: encoder has "a: b", decoder has <none>`)
+}
+
+func TestRejectEmptyNames(t *testing.T) {
+	// literal with incremental indexing, empty literal name and the value "a"
+	block := []byte{0x40, 0x00, 0x01, 0x61}
+
+	decoder := NewDecoder(4096)
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "", Value: "a"}}, headers)
+	assert.Equal(t, []Header{{Name: "", Value: "a"}}, decoder.DynamicTableEntries())
+
+	decoder = NewDecoder(4096)
+	decoder.SetRejectEmptyNames(true)
+	_, err = decoder.Decode(block)
+	assert.Equal(t, ErrEmptyHeaderName, err)
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+	assert.Equal(t, 0, decoder.dynamicTableSizeCurrent)
+}
+
+func TestOversizeStringPolicy(t *testing.T) {
+	encoder := NewEncoder(4096)
+	large := strings.Repeat("a", 100)
+	block, err := encoder.EncodeTrusted([]Header{{Name: ":method", Value: "GET"}}, false)
+	assert.Nil(t, err)
+	for _, header := range []Header{{Name: "custom-key", Value: large}, {Name: large, Value: "b"}, {Name: "password", Value: large, Sensitive: true}} {
+		encoded, err := encoder.EncodeNoDynamicIndexing(header, true)
+		assert.Nil(t, err)
+		block = append(block, encoded...)
+	}
+	encoded, err := encoder.EncodeNoDynamicIndexing(Header{Name: "custom-key", Value: "custom-value"}, false)
+	assert.Nil(t, err)
+	block = append(block, encoded...)
+
+	decoder := NewDecoder(4096)
+	decoder.SetMaxStringLiteralLength(50)
+	_, err = decoder.Decode(block)
+	assert.Equal(t, ErrStringLiteralLengthTooLong, err)
+
+	decoder.SetOversizeStringPolicy(PolicySkip)
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}, {Name: "custom-key", Value: "custom-value"}}, headers)
+
+	// only the decoded length is too long
+	decoder = NewDecoder(4096)
+	decoder.SetMaxDecodedStringLength(80)
+	decoder.SetOversizeStringPolicy(PolicySkip)
+	headers, err = decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}, {Name: "custom-key", Value: "custom-value"}}, headers)
+
+	// a field that would be inserted into the dynamic table can't be skipped
+	block, err = NewEncoder(4096).Encode([]Header{{Name: "custom-key", Value: large}})
+	assert.Nil(t, err)
+	_, err = decoder.Decode(block)
+	assert.Equal(t, ErrStringLiteralLengthTooLong, err)
+}
+
+func TestPeekRepresentation(t *testing.T) {
+	tests := []struct {
+		hexValue       string
+		representation Representation
+	}{
+		// https://tools.ietf.org/html/rfc7541#appendix-C.2
+		{"400a637573746f6d2d6b65790d637573746f6d2d686561646572", RepresentationLiteralIncrementalIndexing},
+		{"040c2f73616d706c652f70617468", RepresentationLiteralNotIndexed},
+		{"100870617373776f726406736563726574", RepresentationLiteralNeverIndexed},
+		{"82", RepresentationIndexed},
+		// https://tools.ietf.org/html/rfc7541#appendix-C.3.2
+		{"828684be5886a8eb10649cbf", RepresentationIndexed},
+		{"3fe11f", RepresentationDynamicTableSizeUpdate},
+		{"20", RepresentationDynamicTableSizeUpdate},
+	}
+	for _, test := range tests {
+		block, err := hex.DecodeString(test.hexValue)
+		assert.Nil(t, err)
+		assert.Equal(t, test.representation, PeekRepresentation(block[0]), test.hexValue)
+	}
+}
+
+func TestEncodePlanned(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoded, err := encoder.EncodePlanned([]FieldPlan{
+		{Representation: RepresentationIndexed, Index: 2},
+		{Representation: RepresentationLiteralIncrementalIndexing, Index: 0, Header: Header{Name: "custom-key", Value: "custom-value"}},
+		{Representation: RepresentationIndexed, Index: 62},
+		{Representation: RepresentationLiteralNotIndexed, Index: 62, Header: Header{Value: "other-value"}},
+		{Representation: RepresentationLiteralNeverIndexed, Index: 4, Header: Header{Value: "/secret"}, Huffman: true},
+		// :method GET would be fully indexed by Encode
+		{Representation: RepresentationLiteralNotIndexed, Index: 2, Header: Header{Value: "GET"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x82, 0x40, 0x0a}, encoded[:3])
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, encoder.DynamicTableEntries())
+	assert.Equal(t, 2, encoder.Stats().IndexedFields)
+	assert.Equal(t, 4, encoder.Stats().LiteralFields)
+	assert.Equal(t, len(encoded), encoder.Stats().EncodedBytes)
+
+	decoder := NewDecoder(4096)
+	fields, err := decoder.DecodeFields(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{
+		{Header: Header{Name: ":method", Value: "GET"}, Representation: RepresentationIndexed},
+		{Header: Header{Name: "custom-key", Value: "custom-value"}, Representation: RepresentationLiteralIncrementalIndexing},
+		{Header: Header{Name: "custom-key", Value: "custom-value"}, Representation: RepresentationIndexed},
+		{Header: Header{Name: "custom-key", Value: "other-value"}, Representation: RepresentationLiteralNotIndexed},
+		{Header: Header{Name: ":path", Value: "/secret", Sensitive: true}, Representation: RepresentationLiteralNeverIndexed},
+		{Header: Header{Name: ":method", Value: "GET"}, Representation: RepresentationLiteralNotIndexed},
+	}, fields)
+	assert.Nil(t, AssertTablesMatch(encoder, decoder))
+}
+
+func TestEncodePlannedInvalid(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetDynamicTableMaxSize(256)
+
+	// index 62 only exists after the first field is inserted
+	_, err := encoder.EncodePlanned([]FieldPlan{
+		{Representation: RepresentationIndexed, Index: 62},
+	})
+	assert.EqualError(t, err, "index not found: index 62 is out of range (61 static and 0 dynamic entries)")
+
+	_, err = encoder.EncodePlanned([]FieldPlan{
+		{Representation: RepresentationLiteralIncrementalIndexing, Header: Header{Name: "custom-key", Value: "custom-value"}},
+		{Representation: RepresentationIndexed, Index: 62},
+		{Representation: RepresentationLiteralNotIndexed, Index: 63, Header: Header{Value: "a"}},
+	})
+	assert.EqualError(t, err, "index not found: index 63 is out of range (61 static and 1 dynamic entries)")
+
+	_, err = encoder.EncodePlanned([]FieldPlan{{Representation: RepresentationIndexed, Index: 0}})
+	assert.EqualError(t, err, "index not found: index 0 is out of range (61 static and 0 dynamic entries)")
+
+	_, err = encoder.EncodePlanned([]FieldPlan{{Representation: RepresentationDynamicTableSizeUpdate}})
+	assert.EqualError(t, err, "can't encode a planned header field as dynamic table size update")
+
+	// nothing was changed by the invalid plans
+	assert.Equal(t, 0, len(encoder.DynamicTableEntries()))
+	assert.True(t, encoder.pendingDynamicTableSizeUpdate)
+	assert.Equal(t, EncoderStats{}, encoder.Stats())
+}
+
+func TestEncodeIntegerWithPrefix(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+
+	encoded, err := encoder.EncodeIntegerWithPrefix(2, 7, headerFieldIndexed)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x82}, encoded)
+	headers, err := decoder.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}}, headers)
+
+	encoded, err = encoder.EncodeIntegerWithPrefix(4096, 5, headerFieldDynamicSizeUpdate)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3f, 0xe1, 0x1f}, encoded)
+	_, masked, size, err := decoder.DecodeInteger(encoded, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, headerFieldDynamicSizeUpdate, masked)
+	assert.Equal(t, 4096, size)
+
+	encoded, err = encoder.EncodeIntegerWithPrefix(1337, 5, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, encoded)
+
+	_, err = encoder.EncodeIntegerWithPrefix(2, 6, headerFieldIndexed|headerFieldDynamicSizeUpdate)
+	assert.Equal(t, ErrPrefixBitsOverlap, err)
+	_, err = encoder.EncodeIntegerWithPrefix(2, 8, headerFieldIndexed)
+	assert.Equal(t, ErrPrefixBitsOverlap, err)
+	_, err = encoder.EncodeIntegerWithPrefix(2, 0, headerFieldIndexed)
+	assert.Equal(t, ErrInvalidPrefixLength, err)
+}
+
+func TestIndexedDynamicTableBoundary(t *testing.T) {
+	decoder := NewDecoder(4096)
+	decoder.addNewDynamicEntry("a", "1")
+	decoder.addNewDynamicEntry("b", "2")
+	decoder.addNewDynamicEntry("c", "3")
+
+	expected := map[byte]Header{
+		0xbe: {Name: "c", Value: "3"},
+		0xbf: {Name: "b", Value: "2"},
+		0xc0: {Name: "a", Value: "1"},
+	}
+	for indexed, header := range expected {
+		headers, err := decoder.Decode([]byte{indexed})
+		assert.Nil(t, err)
+		assert.Equal(t, []Header{header}, headers)
+	}
+
+	// 64 is the last valid index, len(staticTable)+len(dynamicTable)
+	_, err := decoder.Decode([]byte{0xc1})
+	assert.EqualError(t, err, "index not found: index 65 is past the end of the dynamic table (dynamic index 4, 3 entries)")
+}
+
+func TestDecoderOnInsert(t *testing.T) {
+	decoder := NewDecoder(80)
+	events := make([]string, 0)
+	decoder.SetOnInsert(func(inserted Header) {
+		events = append(events, "insert "+inserted.String())
+	})
+	decoder.SetOnEvict(func(evicted Header) {
+		events = append(events, "evict "+evicted.String())
+	})
+
+	encoder := NewEncoder(80)
+	block, err := encoder.Encode([]Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "aaa", Value: "111"},
+		{Name: "bbb", Value: "222"},
+		{Name: "password", Value: "secret", Sensitive: true},
+		{Name: "ccc", Value: "333"},
+	})
+	assert.Nil(t, err)
+	_, err = decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"insert aaa: 111", "insert bbb: 222", "evict aaa: 111", "insert ccc: 333"}, events)
+}
+
+func TestDecoderIndexOf(t *testing.T) {
+	decoder := NewDecoder(4096)
+	decoder.addNewDynamicEntry("custom-key", "custom-value")
+	decoder.addNewDynamicEntry(":path", "/custom")
+
+	tests := []struct {
+		header Header
+		index  int
+		exact  bool
+	}{
+		{Header{Name: ":method", Value: "GET"}, 2, true},
+		{Header{Name: ":method", Value: "PUT"}, 2, false},
+		{Header{Name: ":authority", Value: ""}, 1, false},
+		{Header{Name: ":path", Value: "/custom"}, 62, true},
+		{Header{Name: ":path", Value: "/other"}, 4, false},
+		{Header{Name: "custom-key", Value: "custom-value"}, 63, true},
+		{Header{Name: "custom-key", Value: "other-value"}, -1, false},
+		{Header{Name: "missing", Value: ""}, -1, false},
+	}
+	encoder := NewEncoder(4096)
+	encoder.addNewDynamicEntry("custom-key", "custom-value")
+	encoder.addNewDynamicEntry(":path", "/custom")
+	for _, test := range tests {
+		index, exact := decoder.IndexOf(test.header)
+		assert.Equal(t, test.index, index, test.header.String())
+		assert.Equal(t, test.exact, exact, test.header.String())
+
+		encoderIndex, encoderExact := encoder.findHeaderInTable(test.header.Name, test.header.Value)
+		assert.Equal(t, encoderIndex, index)
+		assert.Equal(t, encoderExact, exact)
+	}
+}
+
+func TestRejectNonMinimalIntegers(t *testing.T) {
+	minimal := []byte{0x1f, 0x9a, 0x0a}
+	redundant := []byte{0x1f, 0x9a, 0x8a, 0x00}
+
+	decoder := NewDecoder(4096)
+	_, _, number, err := decoder.DecodeInteger(redundant, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1337, number)
+
+	decoder.SetRejectNonMinimalIntegers(true)
+	rest, _, number, err := decoder.DecodeInteger(minimal, 5)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, 1337, number)
+	_, _, _, err = decoder.DecodeInteger(redundant, 5)
+	assert.Equal(t, ErrIntegerNotMinimal, err)
+
+	// 31 needs a zero continuation octet with a 5 bit prefix
+	_, _, number, err = decoder.DecodeInteger([]byte{0x1f, 0x00}, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 31, number)
+	_, _, _, err = decoder.DecodeInteger([]byte{0x1f, 0x80, 0x00}, 5)
+	assert.Equal(t, ErrIntegerNotMinimal, err)
+
+	// the index of an indexed header field is checked before it is looked up
+	_, err = decoder.Decode([]byte{0xff, 0x83, 0x80, 0x00})
+	assert.Equal(t, ErrIntegerNotMinimal, err)
+}
+
+func TestEvictionThreshold(t *testing.T) {
+	// each small entry is 32 + 3 + 3 = 38 octets
+	small := []Header{{Name: "aaa", Value: "111"}, {Name: "bbb", Value: "222"}, {Name: "ccc", Value: "333"}, {Name: "ddd", Value: "444"}}
+	large := Header{Name: "large", Value: strings.Repeat("x", 100)}
+
+	encoder := NewEncoder(160)
+	encoder.SetEvictionThreshold(2)
+	_, err := encoder.Encode(small)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(encoder.DynamicTableEntries()))
+
+	// the large header needs 137 octets and would evict all four entries
+	assert.Equal(t, RepresentationLiteralNotIndexed, encoder.WouldIndex(large))
+	encoded, err := encoder.EncodeIndexed(large, false)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x00), encoded[0])
+	assert.Equal(t, 4, len(encoder.DynamicTableEntries()))
+	assert.Equal(t, 0, encoder.LastEncodeEvicted())
+
+	// evicting a single entry is within the threshold
+	medium := Header{Name: "medium", Value: "x"}
+	assert.Equal(t, RepresentationLiteralIncrementalIndexing, encoder.WouldIndex(medium))
+	_, err = encoder.EncodeIndexed(medium, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, encoder.LastEncodeEvicted())
+
+	encoder.SetEvictionThreshold(-1)
+	_, err = encoder.EncodeIndexed(large, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{large}, encoder.DynamicTableEntries())
+}
+
+func TestDecoderTracer(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7541#appendix-C.5
+	encodedHexValues := []string{
+		"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+		"4803333037c1c0bf",
+		"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b2076657273696f6e3d31",
+	}
+	decoder := NewDecoder(256)
+	events := make([]string, 0)
+	decoder.SetTracer(func(event DecodeEvent) {
+		switch event.Type {
+		case EventIndexedField, EventLiteralField:
+			events = append(events, fmt.Sprintf("%s %d %s", event.Representation, event.Index, event.Header))
+		case EventSizeUpdate:
+			events = append(events, fmt.Sprintf("%s %d", event.Type, event.Size))
+		default:
+			events = append(events, fmt.Sprintf("%s %s", event.Type, event.Header))
+		}
+	})
+	for _, hexValue := range encodedHexValues {
+		block, err := hex.DecodeString(hexValue)
+		assert.Nil(t, err)
+		_, err = decoder.Decode(block)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{
+		"literal with incremental indexing 8 :status: 302",
+		"literal with incremental indexing 24 cache-control: private",
+		"literal with incremental indexing 33 date: Mon, 21 Oct 2013 20:13:21 GMT",
+		"literal with incremental indexing 46 location: https://www.example.com",
+
+		"literal with incremental indexing 8 :status: 307",
+		"eviction :status: 302",
+		"indexed 65 cache-control: private",
+		"indexed 64 date: Mon, 21 Oct 2013 20:13:21 GMT",
+		"indexed 63 location: https://www.example.com",
+
+		"indexed 8 :status: 200",
+		"indexed 65 cache-control: private",
+		"literal with incremental indexing 33 date: Mon, 21 Oct 2013 20:13:22 GMT",
+		"eviction cache-control: private",
+		"indexed 64 location: https://www.example.com",
+		"literal with incremental indexing 26 content-encoding: gzip",
+		"eviction date: Mon, 21 Oct 2013 20:13:21 GMT",
+		"literal with incremental indexing 55 set-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		"eviction location: https://www.example.com",
+		"eviction :status: 307",
+	}, events)
+
+	events = events[:0]
+	_, err := decoder.Decode([]byte{0x20, 0x3f, 0x61, 0x10, 0x01, 0x61, 0x01, 0x62})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"size update 0",
+		"eviction date: Mon, 21 Oct 2013 20:13:22 GMT",
+		"eviction content-encoding: gzip",
+		"eviction set-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		"size update 128",
+		"literal never indexed 0 a: b (sensitive)",
+	}, events)
+}
+
+func TestDecodeWithInfo(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7541#appendix-C.5
+	encodedHexValues := []string{
+		"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+		"4803333037c1c0bf",
+		"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b2076657273696f6e3d31",
+	}
+	decoder := NewDecoder(256)
+	for i, evictions := range []int{0, 1, 4} {
+		block, err := hex.DecodeString(encodedHexValues[i])
+		assert.Nil(t, err)
+		headers, info, err := decoder.DecodeWithInfo(block)
+		assert.Nil(t, err)
+		assert.Equal(t, 4+i/2*2, len(headers))
+		assert.Equal(t, DecodeInfo{Evictions: evictions}, info)
+	}
+
+	headers, info, err := decoder.DecodeWithInfo([]byte{0x20, 0x3f, 0x61, 0x10, 0x01, 0x61, 0x01, 0x62})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "a", Value: "b", Sensitive: true}}, headers)
+	assert.Equal(t, DecodeInfo{SizeUpdatesApplied: []int{0, 128}, Evictions: 3}, info)
+	assert.Nil(t, decoder.info)
+}
+
+func TestIncrementalIndexStaticName(t *testing.T) {
+	decoder := NewDecoder(4096)
+
+	// literal with incremental indexing, static name index 1 (:authority) and the value "www.example.com"
+	block := []byte{0x41, 0x0f, 0x77, 0x77, 0x77, 0x2e, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d}
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":authority", Value: "www.example.com"}}, headers)
+	assert.Equal(t, []Header{{Name: ":authority", Value: "www.example.com"}}, decoder.DynamicTableEntries())
+	assert.Equal(t, 57, decoder.dynamicTableSizeCurrent)
+
+	// the static entry is unchanged and the new entry is at index 62
+	headers, err = decoder.Decode([]byte{0x81, 0xbe})
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: ":authority", Value: ""}, {Name: ":authority", Value: "www.example.com"}}, headers)
 }
@@ -1,6 +1,10 @@
 package hpack
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"io"
+)
 
 type bitReader struct {
 	buf      []byte
@@ -18,6 +22,10 @@ func newBitReader(buf []byte) *bitReader {
 
 var ErrHuffmanDecodeFailure = errors.New("invalid huffman code encountered")
 
+// Huffman encoded data that ends in the middle of a code, or with padding that isn't
+// the start of the EOS code. It wraps ErrHuffmanDecodeFailure, so errors.Is matches either.
+var ErrHuffmanTruncated = fmt.Errorf("%w: data ends in the middle of a code", ErrHuffmanDecodeFailure)
+
 func (br *bitReader) PeekBits(numBits int) (int, int) {
 	var n int = 0
 	var idx int = br.index
@@ -56,72 +64,264 @@ func (br *bitReader) ConsumeBits(numBits int) {
 
 // Encodes the specified data with Huffman codes in HPACK
 func HuffmanEncode(data []byte) []byte {
-	encoded := make([]byte, 0)
-	var currentByte byte = 0
-	currentBits := 0
+	return HuffmanEncodeAppend(make([]byte, 0), data)
+}
+
+// Encodes the specified data with Huffman codes in HPACK and appends
+// the result to dst, returning the extended buffer.
+//
+// Callers can pass a reused buffer (e.g. buf[:0]) to avoid allocating on every call.
+func HuffmanEncodeAppend(dst []byte, data []byte) []byte {
+	encoded := dst
+	// bits holds nbits pending bits in its least significant bits, the longest code is
+	// 30 bits so there are never more than 37 pending bits
+	var bits uint64
+	var nbits uint
 	for _, b := range data {
 		entry := huffmanCodes[b]
-		code := entry[0]
-		bits := int(entry[1])
-		bitsRemaining := bits
-
-		for bitsRemaining > 0 {
-			if (code>>uint(bitsRemaining-1))&1 == 1 {
-				currentByte |= 1
-			}
-			bitsRemaining -= 1
-			currentBits += 1
-			if currentBits == 8 {
-				encoded = append(encoded, currentByte)
-				currentByte = 0
-				currentBits = 0
-			} else {
-				currentByte <<= 1
-			}
+		bits = bits<<entry[1] | uint64(entry[0])
+		nbits += uint(entry[1])
+		for nbits >= 8 {
+			nbits -= 8
+			encoded = append(encoded, byte(bits>>nbits))
 		}
 	}
-	if currentBits > 0 && currentBits < 8 {
-		padding := huffmanCodes[256]
-		currentByte <<= 7 - uint(currentBits)
-		currentByte |= byte(padding[0] >> (padding[1] - uint32(8-currentBits)))
-		encoded = append(encoded, currentByte)
+	if nbits > 0 {
+		// pad with the most significant bits of the EOS code, which are all ones
+		padding := 8 - nbits
+		encoded = append(encoded, byte(bits<<padding|(1<<padding-1)))
 	}
 	return encoded
 }
 
 // Decodes the huffman encoded data
 func HuffmanDecode(encoded []byte) ([]byte, error) {
+	return huffmanDecode(encoded, lookupTable, maxInt)
+}
+
+// Decodes the longest sequence of complete symbols at the start of the huffman encoded data
+// and returns it with the number of input bytes that contain those symbols. Decoding stops
+// at the first code that is cut off, and the bits after the last symbol are not required to be
+// valid padding, so consumed is less than len(encoded) if the data is truncated or followed by
+// more than a byte of trailing bits. Use HuffmanDecode to decode a complete HPACK string literal.
+func HuffmanDecodeN(encoded []byte) (decoded []byte, consumed int, err error) {
+	decoded, bitReader, err := huffmanDecodeSymbols(encoded, lookupTable, maxInt)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decoded, (8*len(encoded) - bitReader.BitsAvailable() + 7) / 8, nil
+}
+
+// Decodes the huffman encoded data using rootTable, failing with ErrStringLiteralLengthTooLong
+// as soon as the decoded data would be longer than maxLength. The data must end with valid padding.
+func huffmanDecode(encoded []byte, rootTable []*lookupTableEntry, maxLength int) ([]byte, error) {
+	decoded, bitReader, err := huffmanDecodeSymbols(encoded, rootTable, maxLength)
+	if err != nil {
+		return nil, err
+	}
+	if !bitReader.isPadding() {
+		// every sequence of bits either contains a complete code or is the start of one,
+		// so bits that aren't padding are a code that was cut off
+		return nil, ErrHuffmanTruncated
+	}
+	return decoded, nil
+}
+
+// Decodes symbols until the remaining bits don't contain a complete code. Returns the decoded
+// data and the bit reader positioned after the last symbol.
+func huffmanDecodeSymbols(encoded []byte, rootTable []*lookupTableEntry, maxLength int) ([]byte, *bitReader, error) {
 	decoded := make([]byte, 0)
 
 	bitReader := newBitReader(encoded)
 	for bitReader.BitsAvailable() >= 5 {
 		n, bitsRead := bitReader.PeekBits(32)
 		code := int32(n)
-		decode_success := false
+		var symbol *lookupTableEntry
 
-		table := lookupTable
+		table := rootTable
 		for bitIdx := 0; bitIdx < 32; bitIdx += 8 {
 			entry := table[(code>>(24-uint(bitIdx)))&0xff]
-			if entry != nil {
-				if entry.nextTable != nil {
-					table = entry.nextTable
-				} else {
-					if bitsRead >= int(entry.bits) {
-						decoded = append(decoded, []byte{byte(entry.symbol)}...)
-					}
-					bitReader.ConsumeBits(int(entry.bits))
-					decode_success = true
-					break
-				}
+			if entry == nil {
+				break
+			}
+			if entry.nextTable == nil {
+				symbol = entry
+				break
 			}
+			table = entry.nextTable
+		}
+		if symbol == nil || bitsRead < int(symbol.bits) {
+			// the rest of the data is padding or a code that was cut off
+			break
+		}
+		if symbol.bits == 0 {
+			// every symbol must consume input, otherwise decoding never makes progress
+			return nil, nil, ErrHuffmanDecodeFailure
 		}
-		if !decode_success {
-			if bitsRead <= 7 {
+		if symbol.symbol > 255 {
+			// the EOS symbol must not appear in the encoded data
+			return nil, nil, ErrHuffmanDecodeFailure
+		}
+		if len(decoded) >= maxLength {
+			return nil, nil, ErrStringLiteralLengthTooLong
+		}
+		decoded = append(decoded, byte(symbol.symbol))
+		bitReader.ConsumeBits(int(symbol.bits))
+	}
+	return decoded, bitReader, nil
+}
+
+// Returns true if the remaining bits are valid padding: fewer than 8 bits that match
+// the most significant bits of the EOS code, which are all ones.
+//
+// See https://tools.ietf.org/html/rfc7541#section-5.2
+func (br *bitReader) isPadding() bool {
+	remaining := br.BitsAvailable()
+	if remaining == 0 {
+		return true
+	}
+	if remaining >= 8 {
+		return false
+	}
+	mask := byte(1<<uint(remaining) - 1)
+	return br.buf[br.index]&mask == mask
+}
+
+// A HuffmanReader decodes Huffman encoded data from an underlying reader as it is read,
+// so a large value doesn't have to be decoded all at once.
+type HuffmanReader struct {
+	r     io.Reader
+	in    []byte
+	inBuf [512]byte
+	eof   bool
+	err   error
+
+	// bits holds nbits undecoded bits in its least significant bits
+	bits  uint64
+	nbits uint
+}
+
+// Creates a HuffmanReader that decodes the Huffman encoded data read from r.
+func NewHuffmanReader(r io.Reader) *HuffmanReader {
+	return &HuffmanReader{r: r}
+}
+
+// Reads decoded data into p. Returns ErrHuffmanDecodeFailure if an invalid Huffman code is encountered,
+// or ErrHuffmanTruncated if the data doesn't end with valid padding.
+func (hr *HuffmanReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && hr.err == nil {
+		if hr.nbits < 32 && !hr.eof {
+			if err := hr.fill(); err != nil {
+				hr.err = err
 				break
-			} else {
-				return nil, ErrHuffmanDecodeFailure
 			}
+			if hr.nbits < 32 && !hr.eof {
+				// the underlying reader returned no data
+				break
+			}
+			continue
+		}
+
+		symbol, ok, err := hr.decodeSymbol()
+		if err != nil {
+			hr.err = err
+		} else if !ok {
+			hr.err = io.EOF
+		} else {
+			p[n] = symbol
+			n += 1
 		}
 	}
-	return decoded, nil
+	if n > 0 {
+		return n, nil
+	}
+	return 0, hr.err
+}
+
+func (hr *HuffmanReader) fill() error {
+	for hr.nbits <= 56 {
+		if len(hr.in) == 0 {
+			if hr.eof {
+				return nil
+			}
+			n, err := hr.r.Read(hr.inBuf[:])
+			hr.in = hr.inBuf[:n]
+			if err == io.EOF {
+				hr.eof = true
+			} else if err != nil {
+				return err
+			} else if n == 0 {
+				return nil
+			}
+			continue
+		}
+		hr.bits = hr.bits<<8 | uint64(hr.in[0])
+		hr.nbits += 8
+		hr.in = hr.in[1:]
+	}
+	return nil
+}
+
+// Decodes the next symbol, at least 32 bits must be available unless the end of the input
+// has been reached. Returns false when only padding remains.
+func (hr *HuffmanReader) decodeSymbol() (byte, bool, error) {
+	if hr.nbits < 5 {
+		return hr.endOfInput()
+	}
+
+	var code uint32
+	if hr.nbits >= 32 {
+		code = uint32(hr.bits >> (hr.nbits - 32))
+	} else {
+		code = uint32(hr.bits << (32 - hr.nbits))
+	}
+
+	table := lookupTable
+	for shift := 24; shift >= 0; shift -= 8 {
+		entry := table[(code>>uint(shift))&0xff]
+		if entry == nil {
+			break
+		}
+		if entry.nextTable != nil {
+			table = entry.nextTable
+			continue
+		}
+		if uint(entry.bits) > hr.nbits {
+			// the remaining bits must be padding
+			return hr.endOfInput()
+		}
+		if entry.symbol > 255 {
+			// the EOS symbol must not appear in the encoded data
+			return 0, false, ErrHuffmanDecodeFailure
+		}
+		hr.nbits -= uint(entry.bits)
+		hr.bits &= (1 << hr.nbits) - 1
+		return byte(entry.symbol), true, nil
+	}
+
+	if hr.eof {
+		return hr.endOfInput()
+	}
+	return 0, false, ErrHuffmanDecodeFailure
+}
+
+// Checks that the bits left at the end of the input are valid padding like isPadding,
+// otherwise they are a code that was cut off and ErrHuffmanTruncated is returned.
+func (hr *HuffmanReader) endOfInput() (byte, bool, error) {
+	if hr.nbits >= 8 || hr.bits != (1<<hr.nbits)-1 {
+		return 0, false, ErrHuffmanTruncated
+	}
+	hr.bits = 0
+	hr.nbits = 0
+	return 0, false, nil
+}
+
+// Returns the length of str once Huffman encoded, including the padding.
+func huffmanEncodedLen(str string) int {
+	bits := 0
+	for i := 0; i < len(str); i++ {
+		bits += int(huffmanCodes[str[i]][1])
+	}
+	return (bits + 7) / 8
 }
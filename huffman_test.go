@@ -1,9 +1,14 @@
 package hpack
 
 import (
+	"bytes"
 	"encoding/hex"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"testing"
+	"testing/iotest"
 )
 
 func TestHuffmanEncoding(t *testing.T) {
@@ -54,3 +59,278 @@ func TestHuffmanDecoding(t *testing.T) {
 	}
 
 }
+
+func TestHuffmanEncodeAppend(t *testing.T) {
+	items := []string{"no-cache", "www.example.com", "custom-key", "custom-value", "302", ""}
+
+	buf := make([]byte, 0, 64)
+	for _, item := range items {
+		buf = HuffmanEncodeAppend(buf[:0], []byte(item))
+		assert.Equal(t, HuffmanEncode([]byte(item)), buf)
+	}
+
+	prefix := []byte{0xde, 0xad}
+	appended := HuffmanEncodeAppend(prefix, []byte("no-cache"))
+	assert.Equal(t, append([]byte{0xde, 0xad}, HuffmanEncode([]byte("no-cache"))...), appended)
+}
+
+// Encodes data one bit at a time, as a reference for HuffmanEncodeAppend
+func huffmanEncodeBitwise(data []byte) []byte {
+	encoded := make([]byte, 0)
+	var currentByte byte = 0
+	currentBits := 0
+	for _, b := range data {
+		code := huffmanCodes[b][0]
+		for bitsRemaining := int(huffmanCodes[b][1]); bitsRemaining > 0; bitsRemaining-- {
+			currentByte = currentByte<<1 | byte((code>>uint(bitsRemaining-1))&1)
+			currentBits += 1
+			if currentBits == 8 {
+				encoded = append(encoded, currentByte)
+				currentByte = 0
+				currentBits = 0
+			}
+		}
+	}
+	for currentBits > 0 && currentBits < 8 {
+		currentByte = currentByte<<1 | 1
+		currentBits += 1
+		if currentBits == 8 {
+			encoded = append(encoded, currentByte)
+		}
+	}
+	return encoded
+}
+
+func TestHuffmanEncodeMatchesBitwise(t *testing.T) {
+	all := make([]byte, 256)
+	for x := range all {
+		all[x] = byte(x)
+		assert.Equal(t, huffmanEncodeBitwise([]byte{byte(x)}), HuffmanEncode([]byte{byte(x)}))
+	}
+	assert.Equal(t, huffmanEncodeBitwise(all), HuffmanEncode(all))
+
+	r := rand.New(rand.NewSource(1))
+	for x := 0; x < 1000; x++ {
+		data := make([]byte, r.Intn(64))
+		r.Read(data)
+		assert.Equal(t, huffmanEncodeBitwise(data), HuffmanEncode(data))
+	}
+}
+
+func BenchmarkHuffmanEncodeLong(b *testing.B) {
+	data := bytes.Repeat([]byte("foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"), 64)
+	buf := make([]byte, 0, len(data))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = HuffmanEncodeAppend(buf[:0], data)
+	}
+}
+
+func BenchmarkHuffmanEncode(b *testing.B) {
+	data := []byte("foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HuffmanEncode(data)
+	}
+}
+
+func BenchmarkHuffmanEncodeAppend(b *testing.B) {
+	data := []byte("foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1")
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = HuffmanEncodeAppend(buf[:0], data)
+	}
+}
+
+func TestHuffmanReader(t *testing.T) {
+	items := []string{
+		"no-cache",
+		"www.example.com",
+		"custom-key",
+		"custom-value",
+		"302",
+		"",
+		"foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		string([]byte{0, 1, 2, 254, 255, 128, 10, 13}),
+	}
+
+	for _, item := range items {
+		encoded := HuffmanEncode([]byte(item))
+		expected, err := HuffmanDecode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := ioutil.ReadAll(NewHuffmanReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, decoded)
+		assert.Equal(t, item, string(decoded))
+
+		// read one byte at a time from a reader that returns one byte at a time
+		reader := NewHuffmanReader(iotest.OneByteReader(bytes.NewReader(encoded)))
+		decoded = make([]byte, 0)
+		buf := make([]byte, 1)
+		for {
+			n, err := reader.Read(buf)
+			decoded = append(decoded, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, item, string(decoded))
+	}
+}
+
+func TestHuffmanReaderInvalidCode(t *testing.T) {
+	// the EOS symbol is never valid in the encoded data
+	_, err := ioutil.ReadAll(NewHuffmanReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x00})))
+	assert.Equal(t, ErrHuffmanDecodeFailure, err)
+}
+
+func TestHuffmanDecodeZeroLengthCode(t *testing.T) {
+	table := make([]*lookupTableEntry, 256)
+	for x := range table {
+		table[x] = &lookupTableEntry{symbol: 'a', bits: 0}
+	}
+
+	decoded, err := huffmanDecode([]byte{0x00, 0xff}, table, maxInt)
+	assert.Equal(t, ErrHuffmanDecodeFailure, err)
+	assert.Nil(t, decoded)
+}
+
+func TestHuffmanDecodeN(t *testing.T) {
+	for _, value := range []string{"", "a", "www.example.com", "custom-key", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"} {
+		encoded := HuffmanEncode([]byte(value))
+		decoded, consumed, err := HuffmanDecodeN(encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(decoded))
+		assert.Equal(t, len(encoded), consumed)
+	}
+
+	// '<' and '>' both have 15 bit codes, the truncated code for '>' fills the 3rd byte
+	encoded := HuffmanEncode([]byte("<>"))
+	decoded, consumed, err := HuffmanDecodeN(encoded[:3])
+	assert.Nil(t, err)
+	assert.Equal(t, "<", string(decoded))
+	assert.Equal(t, 2, consumed)
+
+	// an extra byte of padding isn't part of any symbol
+	decoded, consumed, err = HuffmanDecodeN(append(HuffmanEncode([]byte("a")), 0xff))
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(decoded))
+	assert.Equal(t, 1, consumed)
+}
+
+func TestHuffmanDecodeNPadding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoded  []byte
+		decoded  string
+		consumed int
+	}{
+		{"only a full byte of padding", []byte{0xff}, "", 0},
+		// the padding of the last byte is not checked
+		{"3 bits of padding not all ones", []byte{0x1e}, "a", 1},
+	}
+	for _, test := range tests {
+		decoded, consumed, err := HuffmanDecodeN(test.encoded)
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.decoded, string(decoded), test.name)
+		assert.Equal(t, test.consumed, consumed, test.name)
+	}
+
+	// the EOS symbol is never valid in the encoded data
+	decoded, consumed, err := HuffmanDecodeN([]byte{0x1f, 0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, ErrHuffmanDecodeFailure, err)
+	assert.Nil(t, decoded)
+	assert.Equal(t, 0, consumed)
+}
+
+func TestHuffmanDecodePadding(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		decoded string
+		valid   bool
+	}{
+		// '0' is 00000 and 'a' is 00011
+		{"no padding", []byte{0x00, 0x00, 0x00, 0x00, 0x00}, "00000000", true},
+		{"3 bits of padding", []byte{0x1f}, "a", true},
+		{"3 bits of padding not all ones", []byte{0x1e}, "", false},
+		{"6 bits of padding", []byte{0x00, 0x3f}, "00", true},
+		{"7 bits of padding", []byte{0x00, 0x00, 0x00, 0x7f}, "00000", true},
+		{"7 bits of padding not all ones", []byte{0x00, 0x00, 0x00, 0x7e}, "", false},
+		{"a full byte of padding", []byte{0x1f, 0xff}, "", false},
+		{"only a full byte of padding", []byte{0xff}, "", false},
+		{"EOS", []byte{0xff, 0xff, 0xff, 0xff}, "", false},
+		// '<' and '>' both have 15 bit codes, the second code is cut off after 9 bits
+		{"truncated code", []byte{0xff, 0xf9, 0xff}, "", false},
+	}
+	for _, test := range tests {
+		decoded, err := HuffmanDecode(test.encoded)
+		if test.valid {
+			assert.Nil(t, err, test.name)
+			assert.Equal(t, test.decoded, string(decoded), test.name)
+		} else {
+			assert.ErrorIs(t, err, ErrHuffmanDecodeFailure, test.name)
+			assert.Nil(t, decoded, test.name)
+		}
+	}
+}
+
+func TestHuffmanReaderPadding(t *testing.T) {
+	// the reader fails with the same error as HuffmanDecode
+	items := [][]byte{
+		{0x1f}, {0x1e}, {0x00, 0x3f}, {0x00, 0x00, 0x00, 0x7e},
+		{0x1f, 0xff}, {0xff, 0xff, 0xff, 0xff}, {0xff, 0xf9, 0xff},
+	}
+	for _, encoded := range items {
+		expectedDecoded, expected := HuffmanDecode(encoded)
+		decoded, err := ioutil.ReadAll(NewHuffmanReader(bytes.NewReader(encoded)))
+		assert.Equal(t, expected, err, hex.EncodeToString(encoded))
+		if expected == nil {
+			assert.Equal(t, expectedDecoded, decoded, hex.EncodeToString(encoded))
+		}
+
+		_, err = ioutil.ReadAll(NewHuffmanReader(iotest.OneByteReader(bytes.NewReader(encoded))))
+		assert.Equal(t, expected, err, hex.EncodeToString(encoded))
+	}
+
+	// a single 5 bit code followed by 3 zero bits, or a full octet of padding
+	for _, encoded := range [][]byte{{0x00}, {0x0f, 0xff}, {0xff}} {
+		_, err := ioutil.ReadAll(NewHuffmanReader(bytes.NewReader(encoded)))
+		assert.Equal(t, ErrHuffmanTruncated, err, hex.EncodeToString(encoded))
+	}
+}
+
+func TestHuffmanEncodeByteBoundary(t *testing.T) {
+	// each of these ends exactly on a byte boundary, so no padding is added
+	items := []string{
+		"00000000", // 8 5 bit codes
+		"aceiost2", // 8 5 bit codes
+		"BCDEFGHI", // 8 7 bit codes
+		"%-./3456", // 8 6 bit codes
+	}
+	for _, item := range items {
+		bits := 0
+		for _, b := range []byte(item) {
+			bits += int(huffmanCodes[b][1])
+		}
+		assert.Equal(t, 0, bits%8, item)
+
+		encoded := HuffmanEncode([]byte(item))
+		assert.Equal(t, bits/8, len(encoded), item)
+		assert.Equal(t, huffmanEncodeBitwise([]byte(item)), encoded, item)
+
+		decoded, err := HuffmanDecode(encoded)
+		assert.Nil(t, err, item)
+		assert.Equal(t, item, string(decoded))
+	}
+}
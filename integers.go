@@ -1,23 +1,43 @@
 package hpack
 
 import (
-	"math"
+	"io"
 )
 
+// The largest integer that can be decoded, regardless of the configured maximum.
+// On 64-bit platforms this is 2^63-1.
+const maxInt = int(^uint(0) >> 1)
+
 // Decodes an integer from buf with the specified prefix length in number of bits.
 //
 // This function returns the remaining buffer after fully parsing the integer, the first octet with a mask applied to remove the prefix,
 // the decoded number, and an error if an error occurred while parsing.
 //
+// The masked first octet only keeps the bits above the prefix, e.g. the representation bits of a
+// header field (0x80 for an indexed header field with a 7 bit prefix) or the Huffman flag of a
+// string length. It is not shifted, so it can be compared against the unshifted bit patterns.
+//
 // See https://tools.ietf.org/html/rfc7541#section-5.1
 func (decoder *Decoder) DecodeInteger(buf []byte, prefixLength int) (remainingBuf []byte, maskedFirstOctet int, number int, err error) {
-	return decodeInteger(buf, prefixLength, decoder.integerValueMax, decoder.integerEncodedLengthMax)
+	remainingBuf, maskedFirstOctet, number, err = decodeInteger(buf, prefixLength, decoder.integerValueMax, decoder.integerEncodedLengthMax)
+	if err == nil && decoder.rejectNonMinimalIntegers {
+		// a final continuation octet of zero adds nothing, except right after the prefix
+		// where it is needed to encode 2^N-1
+		length := len(buf) - len(remainingBuf)
+		if length > 2 && buf[length-1] == 0 {
+			return nil, 0, 0, ErrIntegerNotMinimal
+		}
+	}
+	return remainingBuf, maskedFirstOctet, number, err
 }
 
 func decodeInteger(buf []byte, prefixLength int, integerMax int, encodedLengthMax int) (remainingBuf []byte, maskedFirstOctet int, number int, err error) {
 	if prefixLength < 1 || prefixLength > 8 {
 		panic("prefix length in bits must be >= 1 and <= 8")
 	}
+	if len(buf) == 0 {
+		return nil, 0, 0, ErrIntegerTruncated
+	}
 	mask := (1<<uint(prefixLength) - 1)
 	n := mask & int(buf[0])
 	prefix := int(buf[0]) &^ mask
@@ -25,12 +45,17 @@ func decodeInteger(buf []byte, prefixLength int, integerMax int, encodedLengthMa
 		return buf[1:], prefix, n, nil
 	} else {
 		idx := 1
-		m := 0
+		var m uint = 0
 		for {
 			if idx == len(buf) {
-				panic("ran out of data while reading HPACK integer")
+				return nil, 0, 0, ErrIntegerTruncated
 			}
-			n += (int(buf[idx]) & 127) * int(math.Pow(2, float64(m)))
+			b := int(buf[idx]) & 127
+			// reject anything that would overflow an int instead of silently wrapping
+			if b > (maxInt-n)>>m {
+				return nil, 0, 0, ErrIntegerValueTooLarge
+			}
+			n += b << m
 			if buf[idx]&(1<<7) == 0 {
 				if n > integerMax {
 					return nil, 0, 0, ErrIntegerValueTooLarge
@@ -48,26 +73,101 @@ func decodeInteger(buf []byte, prefixLength int, integerMax int, encodedLengthMa
 
 // Encodes number with the specified prefix length in number of bits.
 //
+// An error is returned if the prefix length is not between 1 and 8 bits, or
+// ErrNegativeInteger if number is negative, HPACK integers are never negative.
+//
 // See https://tools.ietf.org/html/rfc7541#section-5.1
-func (encoder *Encoder) EncodeInteger(number int, prefixLength int) []byte {
-	return encodeInteger(number, prefixLength)
+func (encoder *Encoder) EncodeInteger(number int, prefixLength int) ([]byte, error) {
+	if prefixLength < 1 || prefixLength > 8 {
+		return nil, ErrInvalidPrefixLength
+	}
+	if number < 0 {
+		return nil, ErrNegativeInteger
+	}
+	return encodeInteger(number, prefixLength), nil
 }
 
+// Encodes number with the specified prefix length in number of bits, with prefixBits OR'd
+// into the first octet, e.g. 0x80 for an indexed header field or 0x20 for a dynamic table
+// size update.
+//
+// An error is returned if the prefix length is not between 1 and 8 bits, if prefixBits
+// has any of the low prefixLength bits set, as those hold the start of the integer, or
+// if number is negative.
+func (encoder *Encoder) EncodeIntegerWithPrefix(number int, prefixLength int, prefixBits byte) ([]byte, error) {
+	if prefixLength < 1 || prefixLength > 8 {
+		return nil, ErrInvalidPrefixLength
+	}
+	if number < 0 {
+		return nil, ErrNegativeInteger
+	}
+	if int(prefixBits)&(1<<uint(prefixLength)-1) != 0 {
+		return nil, ErrPrefixBitsOverlap
+	}
+	encoded := encodeInteger(number, prefixLength)
+	encoded[0] |= prefixBits
+	return encoded, nil
+}
+
+// Encodes number with the specified prefix length in number of bits and writes it to w.
+// The firstByteBits are OR'd into the first octet, e.g. to set the representation type.
+// Nothing is written if number is negative, ErrNegativeInteger is returned instead.
+//
+// See https://tools.ietf.org/html/rfc7541#section-5.1
+func WriteInteger(w io.Writer, number int, prefixLength int, firstByteBits byte) error {
+	if prefixLength < 1 || prefixLength > 8 {
+		return ErrInvalidPrefixLength
+	}
+	if number < 0 {
+		return ErrNegativeInteger
+	}
+	encoded := encodeInteger(number, prefixLength)
+	encoded[0] |= firstByteBits
+	_, err := w.Write(encoded)
+	return err
+}
+
+// Encodes number, which must not be negative, with the specified prefix length in number
+// of bits. Callers outside the encoder go through EncodeInteger or WriteInteger, which
+// check the arguments.
 func encodeInteger(number int, prefixLength int) []byte {
 	if prefixLength < 1 || prefixLength > 8 {
 		panic("prefix length in bits must be >= 1 and <= 8")
 	}
-	if number < int(math.Pow(2, float64(prefixLength)))-1 {
-		return []byte{byte(number)}
-	} else {
-		i := number
-		buf := []byte{byte(int(math.Pow(2, float64(prefixLength))) - 1)}
-		i -= (int(math.Pow(2, float64(prefixLength))) - 1)
-		for i >= 128 {
-			buf = append(buf, byte((i%128)+128))
-			i /= 128
-		}
-		buf = append(buf, byte(i))
-		return buf
+	return appendInteger(make([]byte, 0, 1), number, prefixLength, 0)
+}
+
+// Appends number encoded with the specified prefix length to dst, with prefixBits OR'd
+// into the first octet. The arguments must already be valid, see encodeInteger.
+func appendInteger(dst []byte, number int, prefixLength int, prefixBits byte) []byte {
+	max := 1<<uint(prefixLength) - 1
+	if number < max {
+		return append(dst, byte(number)|prefixBits)
+	}
+	dst = append(dst, byte(max)|prefixBits)
+	i := number - max
+	for i >= 128 {
+		dst = append(dst, byte((i%128)+128))
+		i /= 128
+	}
+	return append(dst, byte(i))
+}
+
+// Returns the number of octets needed to encode number with the specified prefix
+// length in number of bits, including the octet containing the prefix.
+//
+// Returns 0 if the prefix length is not between 1 and 8 bits or number is negative.
+func IntegerEncodedLen(number int, prefixLength int) int {
+	if prefixLength < 1 || prefixLength > 8 || number < 0 {
+		return 0
+	}
+	max := (1 << uint(prefixLength)) - 1
+	if number < max {
+		return 1
+	}
+	length := 2
+	for i := number - max; i >= 128; i /= 128 {
+		length += 1
 	}
+	return length
 }
@@ -0,0 +1,43 @@
+//go:build go1.23
+
+package hpack
+
+import "iter"
+
+// Returns an iterator that parses the HPACK header block one header field at a time,
+// so the headers can be consumed with range without building a list:
+//
+//	for header, err := range decoder.All(block) {
+//		...
+//	}
+//
+// Parsing stops after the first error, which is yielded with an empty header. The decoder's
+// dynamic table is updated as the block is parsed, so if the caller stops early the rest of
+// the block is never parsed and the decoder is out of sync with the encoder.
+func (decoder *Decoder) All(block []byte) iter.Seq2[Header, error] {
+	return func(yield func(Header, error) bool) {
+		if len(block) == 0 && decoder.rejectEmptyBlock {
+			yield(Header{}, ErrEmptyBlock)
+			return
+		}
+		buf := block
+		regularSeen := false
+		for len(buf) > 0 {
+			rest, header, err := decoder.parseHeaderField(buf)
+			if err == nil && len(rest) >= len(buf) {
+				err = ErrDecodeStalled
+			}
+			if err == nil && header != nil {
+				err = decoder.checkPseudoHeader(header, &regularSeen)
+			}
+			if err != nil {
+				yield(Header{}, err)
+				return
+			}
+			buf = rest
+			if header != nil && !yield(*header, nil) {
+				return
+			}
+		}
+	}
+}
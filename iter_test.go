@@ -0,0 +1,67 @@
+//go:build go1.23
+
+package hpack
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDecoderAll(t *testing.T) {
+	encodedHexValues := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	decoder := NewDecoder(4096)
+	allDecoder := NewDecoder(4096)
+	for _, hexValue := range encodedHexValues {
+		block, err := hex.DecodeString(hexValue)
+		assert.Nil(t, err)
+
+		expected, err := decoder.Decode(block)
+		assert.Nil(t, err)
+
+		headers := make([]Header, 0)
+		for header, err := range allDecoder.All(block) {
+			assert.Nil(t, err)
+			headers = append(headers, header)
+		}
+		assert.Equal(t, expected, headers)
+		assert.Equal(t, decoder.DynamicTableEntries(), allDecoder.DynamicTableEntries())
+	}
+}
+
+func TestDecoderAllBreak(t *testing.T) {
+	block, err := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	assert.Nil(t, err)
+
+	decoder := NewDecoder(4096)
+	headers := make([]Header, 0)
+	for header, err := range decoder.All(block) {
+		assert.Nil(t, err)
+		headers = append(headers, header)
+		if len(headers) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}}, headers)
+	// the literal with incremental indexing was never parsed
+	assert.Equal(t, 0, len(decoder.DynamicTableEntries()))
+}
+
+func TestDecoderAllError(t *testing.T) {
+	decoder := NewDecoder(4096)
+	headers := make([]Header, 0)
+	errs := make([]error, 0)
+	for header, err := range decoder.All([]byte{0x82, 0xff, 0x00, 0x82}) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		headers = append(headers, header)
+	}
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}}, headers)
+	assert.Equal(t, 1, len(errs))
+}
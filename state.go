@@ -0,0 +1,206 @@
+package hpack
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidState = errors.New("invalid encoded HPACK state")
+
+// The version of the format written by MarshalState
+const stateVersion = 1
+
+const (
+	stateKindEncoder = 'E'
+	stateKindDecoder = 'D'
+)
+
+// Returns the encoder's compression context in a stable binary format: the dynamic table,
+// its maximum size and any pending dynamic table size update. The state can be restored
+// into another encoder with UnmarshalState, e.g. to keep an HTTP/2 connection's context
+// across a process handoff.
+//
+// Options set with the Set* functions and the statistics are not included, and the static
+// table must be the same in the encoder the state is restored into.
+func (encoder *Encoder) MarshalState() ([]byte, error) {
+	buf := []byte{stateKindEncoder, stateVersion}
+	buf = appendStateInt(buf, encoder.dynamicTableSizeMax)
+	buf = appendStateBool(buf, encoder.pendingDynamicTableSizeUpdate)
+	buf = appendStateInt(buf, encoder.pendingDynamicTableSizeMin)
+	return appendStateEntries(buf, encoder.dynamicTable), nil
+}
+
+// Restores the encoder's compression context from data returned by MarshalState,
+// replacing the dynamic table. Returns ErrInvalidState if data is not a valid encoder state.
+func (encoder *Encoder) UnmarshalState(data []byte) error {
+	r := stateReader{buf: data}
+	r.header(stateKindEncoder)
+	sizeMax := r.int()
+	pending := r.bool()
+	pendingMin := r.int()
+	entries := r.entries()
+	if !r.done() || pendingMin < 0 || !validStateEntries(entries, sizeMax, encoder.entrySizeOf) {
+		return ErrInvalidState
+	}
+
+	encoder.dynamicTable = entries
+	encoder.dynamicTableSizeMax = sizeMax
+	encoder.pendingDynamicTableSizeUpdate = pending
+	encoder.pendingDynamicTableSizeMin = pendingMin
+	encoder.dynamicTableSizeCurrent = encoder.dynamicTableEntriesSize()
+	return nil
+}
+
+// Returns the decoder's compression context in a stable binary format: the dynamic table,
+// its maximum size and the limits for dynamic table size updates, integers and string
+// literals. The state can be restored into another decoder with UnmarshalState.
+//
+// Options set with the other Set* functions are not included, and the static table must
+// be the same in the decoder the state is restored into.
+func (decoder *Decoder) MarshalState() ([]byte, error) {
+	buf := []byte{stateKindDecoder, stateVersion}
+	buf = appendStateInt(buf, decoder.dynamicTableSizeMax)
+	buf = appendStateInt(buf, decoder.dynamicTableSizeLimit)
+	buf = appendStateInt(buf, decoder.integerValueMax)
+	buf = appendStateInt(buf, decoder.integerEncodedLengthMax)
+	buf = appendStateInt(buf, decoder.stringLiteralLengthMax)
+	buf = appendStateInt(buf, decoder.decodedStringLengthMax)
+	return appendStateEntries(buf, decoder.dynamicTable), nil
+}
+
+// Restores the decoder's compression context from data returned by MarshalState,
+// replacing the dynamic table. Returns ErrInvalidState if data is not a valid decoder state.
+func (decoder *Decoder) UnmarshalState(data []byte) error {
+	r := stateReader{buf: data}
+	r.header(stateKindDecoder)
+	sizeMax := r.int()
+	sizeLimit := r.int()
+	integerValueMax := r.int()
+	integerEncodedLengthMax := r.int()
+	stringLiteralLengthMax := r.int()
+	decodedStringLengthMax := r.int()
+	entries := r.entries()
+	if !r.done() || !validStateEntries(entries, sizeMax, decoder.entrySizeOf) {
+		return ErrInvalidState
+	}
+	// the table's maximum size can be above the limit until the encoder acknowledges a lower
+	// limit sent with ApplySettings, so only the limit itself is checked
+	if sizeLimit < 0 || integerValueMax <= 0 || integerEncodedLengthMax <= 0 ||
+		stringLiteralLengthMax <= 0 || decodedStringLengthMax <= 0 {
+		return ErrInvalidState
+	}
+
+	decoder.dynamicTable = entries
+	decoder.dynamicTableSizeMax = sizeMax
+	decoder.dynamicTableSizeLimit = sizeLimit
+	decoder.integerValueMax = integerValueMax
+	decoder.integerEncodedLengthMax = integerEncodedLengthMax
+	decoder.stringLiteralLengthMax = stringLiteralLengthMax
+	decoder.decodedStringLengthMax = decodedStringLengthMax
+	decoder.dynamicTableSizeCurrent = decoder.dynamicTableEntriesSize()
+	return nil
+}
+
+func appendStateInt(buf []byte, n int) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	length := binary.PutVarint(tmp[:], int64(n))
+	return append(buf, tmp[:length]...)
+}
+
+func appendStateBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendStateString(buf []byte, s string) []byte {
+	buf = appendStateInt(buf, len(s))
+	return append(buf, s...)
+}
+
+func appendStateEntries(buf []byte, entries []Header) []byte {
+	buf = appendStateInt(buf, len(entries))
+	for _, entry := range entries {
+		buf = appendStateString(buf, entry.Name)
+		buf = appendStateString(buf, entry.Value)
+	}
+	return buf
+}
+
+// Returns true if the entries fit in a dynamic table of sizeMax.
+func validStateEntries(entries []Header, sizeMax int, entrySize func(name string, value string) int) bool {
+	size := 0
+	for _, entry := range entries {
+		size += entrySize(entry.Name, entry.Value)
+	}
+	return size <= sizeMax
+}
+
+// Reads values written by the appendState functions, after the first error
+// every read returns a zero value and done returns false.
+type stateReader struct {
+	buf     []byte
+	invalid bool
+}
+
+func (r *stateReader) header(kind byte) {
+	if len(r.buf) < 2 || r.buf[0] != kind || r.buf[1] != stateVersion {
+		r.invalid = true
+		return
+	}
+	r.buf = r.buf[2:]
+}
+
+func (r *stateReader) int() int {
+	if r.invalid {
+		return 0
+	}
+	n, length := binary.Varint(r.buf)
+	if length <= 0 || n > int64(maxInt) || n < -int64(maxInt) {
+		r.invalid = true
+		return 0
+	}
+	r.buf = r.buf[length:]
+	return int(n)
+}
+
+func (r *stateReader) bool() bool {
+	if r.invalid || len(r.buf) == 0 || r.buf[0] > 1 {
+		r.invalid = true
+		return false
+	}
+	b := r.buf[0] == 1
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *stateReader) string() string {
+	length := r.int()
+	if r.invalid || length < 0 || length > len(r.buf) {
+		r.invalid = true
+		return ""
+	}
+	s := string(r.buf[:length])
+	r.buf = r.buf[length:]
+	return s
+}
+
+func (r *stateReader) entries() []Header {
+	count := r.int()
+	// every entry needs at least two octets, don't trust the count for the allocation
+	if r.invalid || count < 0 || count > len(r.buf)/2 {
+		r.invalid = true
+		return nil
+	}
+	entries := make([]Header, 0, count)
+	for x := 0; x < count; x++ {
+		entries = append(entries, Header{Name: r.string(), Value: r.string()})
+	}
+	return entries
+}
+
+// Returns true if all the data was read without an error.
+func (r *stateReader) done() bool {
+	return !r.invalid && len(r.buf) == 0
+}
@@ -0,0 +1,134 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDecoderMarshalState(t *testing.T) {
+	encodedHexValues := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	blocks := make([][]byte, len(encodedHexValues))
+	for x, hexValue := range encodedHexValues {
+		block, err := hex.DecodeString(hexValue)
+		assert.Nil(t, err)
+		blocks[x] = block
+	}
+
+	decoder := NewDecoder(4096)
+	decoder.SetMaxStringLiteralLength(512)
+	_, err := decoder.Decode(blocks[0])
+	assert.Nil(t, err)
+
+	state, err := decoder.MarshalState()
+	assert.Nil(t, err)
+
+	restored := NewDecoder(4096)
+	assert.Nil(t, restored.UnmarshalState(state))
+	assert.Equal(t, decoder.DynamicTableEntries(), restored.DynamicTableEntries())
+	assert.Equal(t, decoder.dynamicTableSizeCurrent, restored.dynamicTableSizeCurrent)
+	assert.Equal(t, 512, restored.stringLiteralLengthMax)
+
+	for _, block := range blocks[1:] {
+		expected, err := decoder.Decode(block)
+		assert.Nil(t, err)
+		headers, err := restored.Decode(block)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, headers)
+	}
+	assert.Equal(t, decoder.DynamicTableEntries(), restored.DynamicTableEntries())
+}
+
+func TestEncoderMarshalState(t *testing.T) {
+	encoder := NewEncoder(4096)
+	decoder := NewDecoder(4096)
+	block, err := encoder.Encode([]Header{{Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	_, err = decoder.Decode(block)
+	assert.Nil(t, err)
+	encoder.SetDynamicTableMaxSize(256)
+
+	state, err := encoder.MarshalState()
+	assert.Nil(t, err)
+	restored := NewEncoder(4096)
+	assert.Nil(t, restored.UnmarshalState(state))
+	assert.Equal(t, encoder.DynamicTableEntries(), restored.DynamicTableEntries())
+
+	// the pending size update and the dynamic table entry are kept
+	block, err = restored.Encode([]Header{{Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3f, 0xe1, 0x01, 0xbe}, block)
+	headers, err := decoder.Decode(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-value"}}, headers)
+}
+
+func TestUnmarshalStateInvalid(t *testing.T) {
+	encoder := NewEncoder(4096)
+	_, err := encoder.Encode([]Header{{Name: "custom-key", Value: "custom-value"}})
+	assert.Nil(t, err)
+	encoderState, err := encoder.MarshalState()
+	assert.Nil(t, err)
+	decoderState, err := NewDecoder(4096).MarshalState()
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidState, NewDecoder(4096).UnmarshalState(encoderState))
+	assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(decoderState))
+	assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(nil))
+	for x := 0; x < len(encoderState); x++ {
+		assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(encoderState[:x]))
+	}
+	assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(append(encoderState, 0x00)))
+
+	// the entries don't fit in the table
+	encoder = NewEncoder(4096)
+	encoder.SeedDynamicTable([]Header{{Name: "custom-key", Value: "custom-value"}})
+	encoder.dynamicTableSizeMax = 10
+	state, err := encoder.MarshalState()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(state))
+}
+
+func TestEncoderUnmarshalStateInvalidPendingSize(t *testing.T) {
+	encoder := NewEncoder(4096)
+	encoder.SetDynamicTableMaxSize(256)
+	encoder.pendingDynamicTableSizeMin = -1
+	state, err := encoder.MarshalState()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidState, NewEncoder(4096).UnmarshalState(state))
+}
+
+func TestDecoderUnmarshalStateInvalidLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(decoder *Decoder)
+	}{
+		{"negative size limit", func(decoder *Decoder) { decoder.dynamicTableSizeLimit = -1 }},
+		{"zero integer value limit", func(decoder *Decoder) { decoder.integerValueMax = 0 }},
+		{"negative integer value limit", func(decoder *Decoder) { decoder.integerValueMax = -1 }},
+		{"zero integer encoded length limit", func(decoder *Decoder) { decoder.integerEncodedLengthMax = 0 }},
+		{"zero string literal length limit", func(decoder *Decoder) { decoder.stringLiteralLengthMax = 0 }},
+		{"zero decoded string length limit", func(decoder *Decoder) { decoder.decodedStringLengthMax = 0 }},
+	}
+	for _, test := range tests {
+		decoder := NewDecoder(4096)
+		test.modify(decoder)
+		state, err := decoder.MarshalState()
+		assert.Nil(t, err)
+		assert.Equal(t, ErrInvalidState, NewDecoder(4096).UnmarshalState(state), test.name)
+	}
+
+	// a lower limit applied with ApplySettings is valid before the encoder sends a size update
+	decoder := NewDecoder(4096)
+	decoder.ApplySettings(0)
+	state, err := decoder.MarshalState()
+	assert.Nil(t, err)
+	restored := NewDecoder(256)
+	assert.Nil(t, restored.UnmarshalState(state))
+	assert.Equal(t, 4096, restored.dynamicTableSizeMax)
+	assert.Equal(t, 0, restored.dynamicTableSizeLimit)
+}
@@ -135,3 +135,35 @@ var staticTableEncodingWithValues = map[string]int{
 	":status:500":                   14,
 	"accept-encoding:gzip, deflate": 16,
 }
+
+// Builds the name and name/value lookup maps used for encoding from a static table.
+// The lowest index is used when a name appears more than once.
+func newStaticTableEncoding(entries [][2]string) (map[string]int, map[string]int) {
+	names := make(map[string]int)
+	namesWithValues := make(map[string]int)
+	for x, entry := range entries {
+		if _, ok := names[entry[0]]; !ok {
+			names[entry[0]] = x + 1
+		}
+		if entry[1] != "" {
+			if _, ok := namesWithValues[entry[0]+":"+entry[1]]; !ok {
+				namesWithValues[entry[0]+":"+entry[1]] = x + 1
+			}
+		}
+	}
+	return names, namesWithValues
+}
+
+// Returns the index of the first entry in the HPACK static table with name, and whether
+// there is one.
+func StaticTableNameIndex(name string) (index int, ok bool) {
+	index, ok = staticTableEncoding[name]
+	return index, ok
+}
+
+// Returns the index of the entry in the HPACK static table with both name and value, and
+// whether there is one. Entries with an empty value are only matched by StaticTableNameIndex.
+func StaticTableNameValueIndex(name string, value string) (index int, ok bool) {
+	index, ok = staticTableEncodingWithValues[name+":"+value]
+	return index, ok
+}
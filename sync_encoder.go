@@ -0,0 +1,39 @@
+package hpack
+
+import "sync"
+
+// A SyncEncoder wraps an Encoder with a mutex so it can be called from multiple goroutines.
+//
+// This only makes the calls safe, the compression context is still shared by every caller.
+// With HTTP/2 the header blocks must be sent on the connection in the same order they were
+// encoded in, so an encoder should still be used by a single connection.
+type SyncEncoder struct {
+	mu      sync.Mutex
+	encoder *Encoder
+}
+
+// Creates a SyncEncoder that guards encoder. The encoder must not be used directly afterwards.
+func NewSyncEncoder(encoder *Encoder) *SyncEncoder {
+	return &SyncEncoder{encoder: encoder}
+}
+
+// Encodes the headers like Encoder.Encode
+func (se *SyncEncoder) Encode(headers []Header) ([]byte, error) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.encoder.Encode(headers)
+}
+
+// Encodes the header like Encoder.EncodeIndexed
+func (se *SyncEncoder) EncodeIndexed(header Header, huffman bool) ([]byte, error) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.encoder.EncodeIndexed(header, huffman)
+}
+
+// Updates the dynamic table maximum size like Encoder.SetDynamicTableMaxSize
+func (se *SyncEncoder) SetDynamicTableMaxSize(newMaxSize int) error {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.encoder.SetDynamicTableMaxSize(newMaxSize)
+}
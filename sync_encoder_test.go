@@ -0,0 +1,37 @@
+package hpack
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestSyncEncoder(t *testing.T) {
+	encoder := NewSyncEncoder(NewEncoder(256))
+
+	var wg sync.WaitGroup
+	for x := 0; x < 8; x++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			for y := 0; y < 200; y++ {
+				header := Header{Name: fmt.Sprintf("custom-key-%d", x), Value: fmt.Sprintf("custom-value-%d", y%10)}
+				if y%2 == 0 {
+					_, err := encoder.Encode([]Header{header})
+					assert.Nil(t, err)
+				} else {
+					_, err := encoder.EncodeIndexed(header, false)
+					assert.Nil(t, err)
+				}
+				if y%50 == 0 {
+					encoder.SetDynamicTableMaxSize(128 + x)
+				}
+			}
+		}(x)
+	}
+	wg.Wait()
+
+	assert.True(t, encoder.encoder.dynamicTableSizeCurrent <= encoder.encoder.dynamicTableSizeMax)
+	assert.Nil(t, encoder.encoder.CheckDynamicTableSize())
+}